@@ -0,0 +1,263 @@
+package attestations
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/common"
+)
+
+/// The latest messages of a part of the validators: those with ID % shard count == shard index.
+/// Shards share nothing that changes, so they can process attestations in parallel.
+type aggregatorShard struct {
+
+	agor *AttestationsAggregator
+
+	index uint64
+
+	// aggregation: target -> sum of the latest attestations of the validators of this shard
+	latestAggregates map[common.Hash256]*AggregatedAttestation
+	// lookup: validator -> target + weight contributed by validator
+	latestTargets map[common.ValidatorID]*attestation.Attestation
+
+	equivocators map[common.ValidatorID]bool
+
+	// The votes that were processed (the block was known), by slot, until they are pruned (see pruneVotes).
+	// Two votes for different blocks in the same slot are an equivocation, in whatever order they arrive.
+	votes map[uint64]slotVotes
+}
+
+// The signers that voted for each block, in the same slot.
+type slotVotes map[common.Hash256]*SignerSet
+
+func newAggregatorShard(agor *AttestationsAggregator, index uint64) *aggregatorShard {
+	res := &aggregatorShard{
+		agor: agor,
+		index: index,
+		latestAggregates: make(map[common.Hash256]*AggregatedAttestation),
+		latestTargets: make(map[common.ValidatorID]*attestation.Attestation),
+		equivocators: make(map[common.ValidatorID]bool),
+		votes: make(map[uint64]slotVotes),
+	}
+	return res
+}
+
+// The index of the validator in the signer sets of the shard: the validators of a shard are every n-th ID,
+//  the bitfields would be mostly empty if they were indexed by ID.
+func (sh *aggregatorShard) signer(id common.ValidatorID) common.ValidatorID {
+	return id / common.ValidatorID(len(sh.agor.shards))
+}
+
+// Reverse of signer.
+func (sh *aggregatorShard) validator(signer common.ValidatorID) common.ValidatorID {
+	return signer * common.ValidatorID(len(sh.agor.shards)) + common.ValidatorID(sh.index)
+}
+
+func (sh *aggregatorShard) createAgIfNonExists(key common.Hash256) *AggregatedAttestation {
+	newAg, knownAg := sh.latestAggregates[key]
+	// check if we have to create a new aggregate
+	if !knownAg {
+		newAg = NewAggregatedAttestation(key)
+		sh.latestAggregates[key] = newAg
+	}
+	return newAg
+}
+
+// Processes the attestation, see AttestationsAggregator.AttestationIn.
+// Returns the attestation (with its weight) if its block is not known, it is for the caller to add it to the pending pool.
+func (sh *aggregatorShard) attestationIn(atIn *attestation.Attestation) *attestation.Attestation {
+	if sh.equivocators[atIn.Attester] {
+		// Equivocating validators do not count anymore.
+		return nil
+	}
+	if sh.agor.WeightLookup != nil {
+		weight, ok := sh.agor.WeightLookup(atIn.Attester)
+		if !ok {
+			return nil
+		}
+		// the aggregator keeps the attestation, make a copy with the current weight.
+		at := *atIn
+		at.Weight = weight
+		atIn = &at
+	}
+	if atIn.Slot < sh.agor.MinSlot {
+		// Expired already, it does not count.
+		return nil
+	}
+	newSlot, ok := sh.agor.SlotLookup(atIn.BeaconBlockRoot)
+	if !ok {
+		// The block is not known (yet), wait for it.
+		return atIn
+	}
+	own, others := sh.slotVotes(atIn.Slot, atIn.BeaconBlockRoot)
+	if !recordVote(sh.signer(atIn.Attester), own, others) {
+		sh.onEquivocation(atIn.Attester)
+		return nil
+	}
+	sh.latestMessageIn(atIn, newSlot, sh.createAgIfNonExists(atIn.BeaconBlockRoot))
+	return nil
+}
+
+// Makes the attestation the latest message of the attester, if it is later than the current one.
+// The target of the attestation is known, at newSlot, newAg is its aggregate. The vote is recorded already.
+func (sh *aggregatorShard) latestMessageIn(atIn *attestation.Attestation, newSlot uint64, newAg *AggregatedAttestation) {
+	prevContrib, hasPrevContrib := sh.latestTargets[atIn.Attester]
+	if hasPrevContrib {
+
+		prevAg := sh.latestAggregates[prevContrib.BeaconBlockRoot]
+		prevSlot, prevOk := sh.agor.SlotLookup(prevContrib.BeaconBlockRoot)
+		if !prevOk || prevSlot > newSlot {
+			// We're going to ignore it. Too old, it's not later.
+			return
+		}
+
+		// if the target changed, we move the attestation
+		if prevAg != newAg {
+
+			// remove old attestation from old aggregate (if it was not cleaned up)
+			if prevAg != nil {
+				prevAg.RemoveAttestation(prevContrib, sh.signer(prevContrib.Attester))
+			}
+			// add new attestation to new aggregate
+			newAg.AddAttestation(atIn, sh.signer(atIn.Attester))
+
+			// update target
+			sh.latestTargets[atIn.Attester] = atIn
+			return
+		} else if atIn.Weight != prevContrib.Weight {
+			// if only just the weight changed, we just update.
+
+			prevAg.UpdateAttestation(atIn, prevContrib)
+
+			// update target
+			sh.latestTargets[atIn.Attester] = atIn
+			return
+		} else {
+			// False alarm, nothing has changed
+			return
+		}
+	} else {
+		// add to new aggregate
+		newAg.AddAttestation(atIn, sh.signer(atIn.Attester))
+
+		// update target
+		sh.latestTargets[atIn.Attester] = atIn
+	}
+}
+
+// The signers of the votes for the block in the slot, and those of the votes for other blocks in the same slot.
+// Looked up once for all votes of an aggregate.
+func (sh *aggregatorShard) slotVotes(slot uint64, root common.Hash256) (own *SignerSet, others []*SignerSet) {
+	votes, ok := sh.votes[slot]
+	if !ok {
+		votes = make(slotVotes)
+		sh.votes[slot] = votes
+	}
+	for k, v := range votes {
+		if k != root {
+			others = append(others, v)
+		}
+	}
+	own, ok = votes[root]
+	if !ok {
+		own = new(SignerSet)
+		votes[root] = own
+	}
+	return own, others
+}
+
+// Remembers the vote of the signer, see slotVotes. Returns false if the signer voted for a different block in the same slot before.
+func recordVote(signer common.ValidatorID, own *SignerSet, others []*SignerSet) bool {
+	for _, s := range others {
+		if s.Has(signer) {
+			return false
+		}
+	}
+	own.Add(signer)
+	return true
+}
+
+// Forgets the votes for slots before minSlot, conflicts with these are not detected anymore.
+func (sh *aggregatorShard) pruneVotes(minSlot uint64) {
+	for slot := range sh.votes {
+		if slot < minSlot {
+			// deletion during map iteration, safe in Go
+			delete(sh.votes, slot)
+		}
+	}
+}
+
+func (sh *aggregatorShard) updateWeight(attester common.ValidatorID, weight uint64) {
+	prevContrib, ok := sh.latestTargets[attester]
+	if !ok || prevContrib.Weight == weight {
+		return
+	}
+	prevAg, ok := sh.latestAggregates[prevContrib.BeaconBlockRoot]
+	if !ok {
+		return
+	}
+	at := *prevContrib
+	at.Weight = weight
+	prevAg.UpdateAttestation(&at, prevContrib)
+	sh.latestTargets[attester] = &at
+}
+
+func (sh *aggregatorShard) removeLatest(attester common.ValidatorID) {
+	prevContrib, ok := sh.latestTargets[attester]
+	if !ok {
+		return
+	}
+	// the dag picks up the change like any other weight change (PrevWeight != Weight).
+	if prevAg, ok := sh.latestAggregates[prevContrib.BeaconBlockRoot]; ok {
+		prevAg.RemoveAttestation(prevContrib, sh.signer(attester))
+	}
+	delete(sh.latestTargets, attester)
+}
+
+// Marks the validator as equivocating, and removes its weight from its latest target, if any.
+func (sh *aggregatorShard) onEquivocation(attester common.ValidatorID) {
+	sh.equivocators[attester] = true
+	// the weight is removed from the aggregate,
+	//  the dag picks up the change like any other weight change (PrevWeight != Weight).
+	sh.removeLatest(attester)
+	// its attestations are ignored from now on, its recorded votes are not checked anymore, and pruned with the others.
+}
+
+func (sh *aggregatorShard) expireAttestations(minSlot uint64) {
+	for k, v := range sh.latestTargets {
+		if v.Slot < minSlot {
+			// the dag picks up the change like any other weight change (PrevWeight != Weight).
+			if ag, ok := sh.latestAggregates[v.BeaconBlockRoot]; ok {
+				ag.RemoveAttestation(v, sh.signer(k))
+			}
+			// deletion during map iteration, safe in Go
+			delete(sh.latestTargets, k)
+		}
+	}
+}
+
+// The weight changes since the last call, per target. Resolves the changes: PrevWeight is set to Weight.
+func (sh *aggregatorShard) takeDeltas() []WeightDelta {
+	res := make([]WeightDelta, 0)
+	for k, v := range sh.latestAggregates {
+		if v.PrevWeight != v.Weight {
+			res = append(res, WeightDelta{Target: k, Delta: int64(v.Weight) - int64(v.PrevWeight)})
+			v.PrevWeight = v.Weight
+		}
+	}
+	return res
+}
+
+func (sh *aggregatorShard) cleanup() {
+	aliveTargets := make(map[common.Hash256]bool)
+	for _, v := range sh.latestTargets {
+		aliveTargets[v.BeaconBlockRoot] = true
+	}
+	for k, v := range sh.latestAggregates {
+		// Check if aggregate is unprocessed; in this case it doesn't matter if it's a current target or not,
+		//  it needs to be processed first.
+		// So: if it's processed, or not an alive target, then delete it
+		if v.PrevWeight == v.Weight || !aliveTargets[k] {
+			// safe in Go
+			delete(sh.latestAggregates, k)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package attestation
+
+import (
+	"fmt"
+	"lmd-ghost/eth2/common"
+)
+
+/// Attestation of a committee, as gossiped: the participating members are marked in a bitfield,
+///  indexed by their position in the committee.
+type AggregateAttestation struct {
+
+	BeaconBlockRoot common.Hash256
+
+	Slot uint64
+
+	CommitteeIndex uint64
+
+	// Bit i (byte i / 8, bit i % 8) is set if the i-th member of the committee participates.
+	// The bitfield is exactly as long as needed for the committee, unused bits are 0.
+	AggregationBits []byte
+}
+
+/// Creates an aggregate without participants, for a committee of the given size.
+func NewAggregateAttestation(root common.Hash256, slot uint64, committeeIndex uint64, committeeSize int) *AggregateAttestation {
+	res := &AggregateAttestation{
+		BeaconBlockRoot: root,
+		Slot: slot,
+		CommitteeIndex: committeeIndex,
+		AggregationBits: make([]byte, (committeeSize + 7) / 8),
+	}
+	return res
+}
+
+/// Marks the i-th member of the committee as participating.
+func (agg *AggregateAttestation) SetParticipant(i int) {
+	agg.AggregationBits[i >> 3] |= 1 << uint(i & 7)
+}
+
+/// Expands the bitfield into the positions of the participating members in the committee, in committee order.
+func (agg *AggregateAttestation) Participants(committeeSize int) ([]int, error) {
+	if len(agg.AggregationBits) != (committeeSize + 7) / 8 {
+		return nil, fmt.Errorf("aggregation bits of %d bytes do not match committee size %d", len(agg.AggregationBits), committeeSize)
+	}
+	res := make([]int, 0, committeeSize)
+	for i, b := range agg.AggregationBits {
+		if b == 0 {
+			continue
+		}
+		for j := 0; j < 8; j++ {
+			if b & (1 << uint(j)) == 0 {
+				continue
+			}
+			k := i << 3 + j
+			if k >= committeeSize {
+				return nil, fmt.Errorf("aggregation bit %d is set, but committee size is %d", k, committeeSize)
+			}
+			res = append(res, k)
+		}
+	}
+	return res, nil
+}
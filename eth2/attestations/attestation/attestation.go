@@ -8,5 +8,8 @@ type Attestation struct {
 
 	Attester common.ValidatorID
 
+	// The slot the attestation was made in. A validator attests at most once per slot.
+	Slot uint64
+
 	Weight uint64
 }
@@ -3,10 +3,16 @@ package attestations
 import (
 	"lmd-ghost/eth2/attestations/attestation"
 	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"runtime"
+	"sort"
+	"sync"
 )
 
 type SlotLookupFn func(blockHash common.Hash256) (uint64, bool)
 
+type WeightLookupFn func(attester common.ValidatorID) (uint64, bool)
+
 type AggregatedAttestation struct {
 
 	Target common.Hash256
@@ -15,7 +21,8 @@ type AggregatedAttestation struct {
 	// only the dag can make an update, and set prev to current. Effectively like a "dirty" flag.
 	PrevWeight uint64
 
-	// TODO: could contain a list signatures or something.
+	// The validators whose latest message is this target, by their index within their shard of the aggregator.
+	Signers SignerSet
 }
 
 func NewAggregatedAttestation(target common.Hash256) *AggregatedAttestation {
@@ -29,113 +36,343 @@ func NewAggregatedAttestation(target common.Hash256) *AggregatedAttestation {
 
 
 func (at *AggregatedAttestation) UpdateAttestation(atIn *attestation.Attestation, atOut *attestation.Attestation) {
-	// TODO: does signer list need to be updated, if only the weight changed?
-
+	// only the weight changed, the signer is the same.
 	at.Weight += atIn.Weight
 	at.Weight -= atOut.Weight
 }
 
-func (at *AggregatedAttestation) RemoveAttestation(atOut *attestation.Attestation) {
-	// TODO: remove attester from signers list
-
+func (at *AggregatedAttestation) RemoveAttestation(atOut *attestation.Attestation, signer common.ValidatorID) {
+	at.Signers.Remove(signer)
 	at.Weight -= atOut.Weight
 }
 
-func (at *AggregatedAttestation) AddAttestation(atIn *attestation.Attestation) {
-	// TODO: add attester to signers list
-
+func (at *AggregatedAttestation) AddAttestation(atIn *attestation.Attestation, signer common.ValidatorID) {
+	at.Signers.Add(signer)
 	at.Weight += atIn.Weight
 }
 
+/// A change of the weight of the votes for a target.
+type WeightDelta struct {
+	Target common.Hash256
+	Delta int64
+}
+
+// Batches with less than this per core are processed by the calling goroutine, starting goroutines would cost more than it saves.
+const minParallelBatch = 256
+
+/// Keeps the latest message of every validator, and the sum of the weights of the latest messages per target.
+/// The validators are split between shards, by ID. Batches of attestations (AttestationsIn, AggregateIn)
+///  are processed in parallel, a goroutine per shard. Every shard aggregates the weights of its own validators,
+///  the dag merges the changes of all shards (see TakeDeltas).
+/// Not safe for concurrent use: the parallelism is within a call.
 type AttestationsAggregator struct {
 
-	// aggregation: target -> sum of all attestations
-	LatestAggregates map[common.Hash256]*AggregatedAttestation
-	// lookup: validator -> target + weight contributed by validator
-	LatestTargets map[common.ValidatorID]*attestation.Attestation
+	shards []*aggregatorShard
 
 	SlotLookup SlotLookupFn
+
+	// Optional: the weight of an attestation is looked up when it is processed (e.g. the effective balance of the attester),
+	//  instead of using the weight of the attestation itself. Attestations of unknown attesters are ignored.
+	// Must be safe for concurrent reads, batches look up weights in parallel.
+	WeightLookup WeightLookupFn
+
+	// Attestations for slots before this slot have expired, and are ignored. Zero if votes do not expire.
+	MinSlot uint64
+
+	// Attestations for blocks that are not known yet, these are replayed when the block arrives (see OnBlockIn).
+	Pending *PendingPool
 }
 
-func NewAttestationsAggregator(slotLookup SlotLookupFn) *AttestationsAggregator {
+/// Creates an aggregator with the given amount of shards, e.g. the amount of cores.
+/// The slot lookup is called in parallel, it must be safe for concurrent reads.
+func NewAttestationsAggregator(slotLookup SlotLookupFn, shardCount int) *AttestationsAggregator {
+	if shardCount < 1 {
+		shardCount = 1
+	}
 	res := &AttestationsAggregator{
-		LatestAggregates: make(map[common.Hash256]*AggregatedAttestation),
-		LatestTargets: make(map[common.ValidatorID]*attestation.Attestation),
+		shards: make([]*aggregatorShard, shardCount),
 		SlotLookup: slotLookup,
+		Pending: NewPendingPool(constants.PENDING_ATTESTATIONS_LIMIT, constants.PENDING_ATTESTATIONS_EXPIRY),
+	}
+	for i := range res.shards {
+		res.shards[i] = newAggregatorShard(res, uint64(i))
 	}
 	return res
 }
 
-func (agor *AttestationsAggregator) createAgIfNonExists(key common.Hash256) *AggregatedAttestation {
-	newAg, knownAg := agor.LatestAggregates[key]
-	// check if we have to create a new aggregate
-	if !knownAg {
-		newAg = NewAggregatedAttestation(key)
-		agor.LatestAggregates[key] = newAg
+func (agor *AttestationsAggregator) shardIndex(id common.ValidatorID) uint64 {
+	return uint64(id) % uint64(len(agor.shards))
+}
+
+func (agor *AttestationsAggregator) shard(id common.ValidatorID) *aggregatorShard {
+	return agor.shards[agor.shardIndex(id)]
+}
+
+// Splits a batch by shard, once: the indices of the attesters of every shard, in batch order.
+func (agor *AttestationsAggregator) partition(count int, attester func(i int) common.ValidatorID) [][]int {
+	res := make([][]int, len(agor.shards))
+	for i := 0; i < count; i++ {
+		s := agor.shardIndex(attester(i))
+		res[s] = append(res[s], i)
 	}
-	return newAg
+	return res
 }
 
+// Processing the given amount of entries is only worth a goroutine per shard if more than one core runs the shards,
+//  and every core gets at least minParallelBatch entries. With GOMAXPROCS 1 the goroutines would only take turns.
+func (agor *AttestationsAggregator) worthParallel(entries int) bool {
+	cores := runtime.GOMAXPROCS(0)
+	if len(agor.shards) < cores {
+		cores = len(agor.shards)
+	}
+	return cores > 1 && entries >= minParallelBatch * cores
+}
+
+// A pass over the shards (e.g. when changes are synced) is only worth the goroutines
+//  if the shards hold enough entries to go through, in total, see worthParallel.
+func (agor *AttestationsAggregator) largePass(entries func(sh *aggregatorShard) int) bool {
+	total := 0
+	for _, sh := range agor.shards {
+		total += entries(sh)
+	}
+	return agor.worthParallel(total)
+}
+
+// Runs fn for every shard, in parallel if parallel is true (and there is more than one shard).
+func (agor *AttestationsAggregator) forEachShard(parallel bool, fn func(sh *aggregatorShard)) {
+	if !parallel || len(agor.shards) == 1 {
+		for _, sh := range agor.shards {
+			fn(sh)
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(agor.shards))
+	for _, sh := range agor.shards {
+		go func(sh *aggregatorShard) {
+			defer wg.Done()
+			fn(sh)
+		}(sh)
+	}
+	wg.Wait()
+}
+
+/// Adds the attestation, it becomes the latest message of the attester if it is for a later block.
+/// A validator that votes for two different blocks in the same slot is equivocating: its weight is removed, permanently,
+///  and its attestations are ignored. The votes are remembered until they are pruned (see PruneVotes), in any order.
+/// Attestations for blocks that are not known yet are checked when they are replayed from the pending pool.
 func (agor *AttestationsAggregator) AttestationIn(atIn *attestation.Attestation) {
-	prevContrib, hasPrevContrib := agor.LatestTargets[atIn.Attester]
-	if hasPrevContrib {
-
-		prevAg := agor.LatestAggregates[prevContrib.BeaconBlockRoot]
-		prevSlot, prevOk := agor.SlotLookup(prevContrib.BeaconBlockRoot)
-		newSlot, newOk := agor.SlotLookup(atIn.BeaconBlockRoot)
-		if !prevOk || !newOk || prevSlot > newSlot {
-			// We're going to ignore it. Too old, it's not later.
+	if pending := agor.shard(atIn.Attester).attestationIn(atIn); pending != nil {
+		agor.Pending.Add(pending)
+	}
+}
+
+/// Adds the attestations, with the same result as AttestationIn for every attestation, in order.
+/// Large batches are processed in parallel: every shard processes the attestations of its validators.
+func (agor *AttestationsAggregator) AttestationsIn(ats []*attestation.Attestation) {
+	if !agor.worthParallel(len(ats)) {
+		for _, at := range ats {
+			agor.AttestationIn(at)
+		}
+		return
+	}
+	parts := agor.partition(len(ats), func(i int) common.ValidatorID {
+		return ats[i].Attester
+	})
+	// the attestations for unknown blocks, by index in the batch, so the pending pool gets them in order.
+	pending := make([]*attestation.Attestation, len(ats))
+	agor.forEachShard(true, func(sh *aggregatorShard) {
+		for _, i := range parts[sh.index] {
+			pending[i] = sh.attestationIn(ats[i])
+		}
+	})
+	for _, at := range pending {
+		if at != nil {
+			agor.Pending.Add(at)
+		}
+	}
+}
+
+/// Adds the votes of an aggregate of a committee: every attester votes for the same block, in the same slot.
+/// Equivalent to AttestationIn for every attester (with the given weight), but the target, its aggregates,
+///  and the recorded votes of the slot are looked up once, and the attestations are allocated at once. The weights are not looked up, the caller has them from the committee.
+/// Large aggregates are processed in parallel, like AttestationsIn.
+func (agor *AttestationsAggregator) AggregateIn(blockRoot common.Hash256, slot uint64, attesters []common.ValidatorID, weights []uint64) {
+	if slot < agor.MinSlot {
+		// Expired already, it does not count.
+		return
+	}
+	ats := make([]attestation.Attestation, len(attesters))
+	newSlot, known := agor.SlotLookup(blockRoot)
+	if !known {
+		for i, id := range attesters {
+			if agor.shard(id).equivocators[id] {
+				continue
+			}
+			atIn := &ats[i]
+			*atIn = attestation.Attestation{BeaconBlockRoot: blockRoot, Attester: id, Slot: slot, Weight: weights[i]}
+			// The block is not known (yet), wait for it.
+			agor.Pending.Add(atIn)
+		}
+		return
+	}
+	parts := agor.partition(len(attesters), func(i int) common.ValidatorID {
+		return attesters[i]
+	})
+	agor.forEachShard(agor.worthParallel(len(attesters)), func(sh *aggregatorShard) {
+		if len(parts[sh.index]) == 0 {
 			return
 		}
+		newAg := sh.createAgIfNonExists(blockRoot)
+		own, others := sh.slotVotes(slot, blockRoot)
+		for _, i := range parts[sh.index] {
+			id := attesters[i]
+			if sh.equivocators[id] {
+				continue
+			}
+			if !recordVote(sh.signer(id), own, others) {
+				sh.onEquivocation(id)
+				continue
+			}
+			atIn := &ats[i]
+			*atIn = attestation.Attestation{BeaconBlockRoot: blockRoot, Attester: id, Slot: slot, Weight: weights[i]}
+			sh.latestMessageIn(atIn, newSlot, newAg)
+		}
+	})
+}
 
-		// add to new aggregate, create aggregate if it does not exist yet
-		newAg := agor.createAgIfNonExists(atIn.BeaconBlockRoot)
+/// Replays the attestations that were waiting for the block, now that it is known.
+func (agor *AttestationsAggregator) OnBlockIn(blockHash common.Hash256) {
+	agor.AttestationsIn(agor.Pending.Take(blockHash))
+}
 
-		// if the target changed, we move the attestation
-		if prevAg != newAg {
+/// Changes the weight of the latest message of the validator, if any, e.g. when its effective balance changed.
+/// The dag picks up the change like any other weight change.
+func (agor *AttestationsAggregator) UpdateWeight(attester common.ValidatorID, weight uint64) {
+	agor.shard(attester).updateWeight(attester, weight)
+}
 
-			// remove old attestation from old aggregate
-			prevAg.RemoveAttestation(prevContrib)
-			// add new attestation to new aggregate
-			newAg.AddAttestation(atIn)
+/// Removes the latest message of the validator, if any, e.g. when it exited. Its weight is removed from its target.
+/// Note: this does not stop new attestations of the validator from counting, see WeightLookup for that.
+func (agor *AttestationsAggregator) RemoveLatest(attester common.ValidatorID) {
+	agor.shard(attester).removeLatest(attester)
+}
 
-			// update target
-			agor.LatestTargets[atIn.Attester] = atIn
-			return
-		} else if atIn.Weight != prevContrib.Weight {
-			// if only just the weight changed, we just update.
+/// Expires all latest messages for slots before minSlot: their weight is removed from their targets.
+/// The validators are forgotten, their next attestation counts as their first.
+func (agor *AttestationsAggregator) ExpireAttestations(minSlot uint64) {
+	if minSlot <= agor.MinSlot {
+		return
+	}
+	agor.MinSlot = minSlot
+	parallel := agor.largePass(func(sh *aggregatorShard) int {
+		return len(sh.latestTargets)
+	})
+	agor.forEachShard(parallel, func(sh *aggregatorShard) {
+		sh.expireAttestations(minSlot)
+	})
+}
 
-			prevAg.UpdateAttestation(atIn, prevContrib)
+/// Forgets the votes for slots before minSlot, e.g. the finalized slot. Conflicts with these are not detected anymore.
+func (agor *AttestationsAggregator) PruneVotes(minSlot uint64) {
+	parallel := agor.largePass(func(sh *aggregatorShard) int {
+		return len(sh.votes)
+	})
+	agor.forEachShard(parallel, func(sh *aggregatorShard) {
+		sh.pruneVotes(minSlot)
+	})
+}
 
-			// update target
-			agor.LatestTargets[atIn.Attester] = atIn
-			return
-		} else {
-			// False alarm, nothing has changed
-			return
+/// The weight changes since the last call, per shard. A target may have a change in multiple shards.
+/// The changes are resolved: the next call only returns newer changes.
+func (agor *AttestationsAggregator) TakeDeltas() [][]WeightDelta {
+	res := make([][]WeightDelta, len(agor.shards))
+	parallel := agor.largePass(func(sh *aggregatorShard) int {
+		return len(sh.latestAggregates)
+	})
+	agor.forEachShard(parallel, func(sh *aggregatorShard) {
+		res[sh.index] = sh.takeDeltas()
+	})
+	return res
+}
+
+/// The weight of the votes for the target (not its descendants), as of the last TakeDeltas.
+func (agor *AttestationsAggregator) AppliedWeight(target common.Hash256) uint64 {
+	weight := uint64(0)
+	for _, sh := range agor.shards {
+		if ag, ok := sh.latestAggregates[target]; ok {
+			weight += ag.PrevWeight
 		}
-	} else {
-		// add to new aggregate, create aggregate if it does not exist yet
-		newAg := agor.createAgIfNonExists(atIn.BeaconBlockRoot)
-		newAg.AddAttestation(atIn)
+	}
+	return weight
+}
 
-		// update target
-		agor.LatestTargets[atIn.Attester] = atIn
+/// The current weight of the votes per target (not their descendants). Targets without votes may be left out.
+func (agor *AttestationsAggregator) Weights() map[common.Hash256]uint64 {
+	res := make(map[common.Hash256]uint64)
+	for _, sh := range agor.shards {
+		for k, v := range sh.latestAggregates {
+			res[k] += v.Weight
+		}
 	}
+	return res
 }
 
-func (agor *AttestationsAggregator) Cleanup() {
-	aliveTargets := make(map[common.Hash256]bool)
-	for _, v := range agor.LatestTargets {
-		aliveTargets[v.BeaconBlockRoot] = true
-	}
-	for k, v := range agor.LatestAggregates {
-		// Check if aggregate is unprocessed; in this case it doesn't matter if it's a current target or not,
-		//  it needs to be processed first.
-		// So: if it's processed, or not an alive target, then delete it
-		if v.PrevWeight == v.Weight || !aliveTargets[k] {
-			// safe in Go
-			delete(agor.LatestAggregates, k)
+/// The latest message of the validator, if it has one that counts.
+func (agor *AttestationsAggregator) LatestMessage(id common.ValidatorID) (*attestation.Attestation, bool) {
+	at, ok := agor.shard(id).latestTargets[id]
+	return at, ok
+}
+
+/// The validators whose latest message votes for the target (not its descendants), sorted by ID.
+func (agor *AttestationsAggregator) Voters(target common.Hash256) []common.ValidatorID {
+	var res []common.ValidatorID
+	for _, sh := range agor.shards {
+		if ag, ok := sh.latestAggregates[target]; ok {
+			for _, signer := range ag.Signers.IDs() {
+				res = append(res, sh.validator(signer))
+			}
+		}
+	}
+	sortIDs(res)
+	return res
+}
+
+/// The part of the weight of the votes for the target (not its descendants) that comes from the given validators.
+func (agor *AttestationsAggregator) WeightFrom(target common.Hash256, validators []common.ValidatorID) uint64 {
+	weight := uint64(0)
+	for _, id := range validators {
+		sh := agor.shard(id)
+		if ag, ok := sh.latestAggregates[target]; ok && ag.Signers.Has(sh.signer(id)) {
+			weight += sh.latestTargets[id].Weight
 		}
 	}
+	return weight
+}
+
+/// Returns all validators that have been found equivocating, sorted by ID.
+func (agor *AttestationsAggregator) EquivocatingValidators() []common.ValidatorID {
+	res := make([]common.ValidatorID, 0)
+	for _, sh := range agor.shards {
+		for id := range sh.equivocators {
+			res = append(res, id)
+		}
+	}
+	sortIDs(res)
+	return res
+}
+
+func sortIDs(ids []common.ValidatorID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+}
+
+func (agor *AttestationsAggregator) Cleanup() {
+	parallel := agor.largePass(func(sh *aggregatorShard) int {
+		return len(sh.latestTargets) + len(sh.latestAggregates)
+	})
+	agor.forEachShard(parallel, func(sh *aggregatorShard) {
+		sh.cleanup()
+	})
 }
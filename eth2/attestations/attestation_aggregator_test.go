@@ -0,0 +1,144 @@
+package attestations
+
+import (
+	"fmt"
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/common"
+	"runtime"
+	"testing"
+)
+
+// Blocks 1..3 at slots 1..3, and their hashes.
+func testAggregator(shards int) (*AttestationsAggregator, []common.Hash256) {
+	roots := []common.Hash256{{1}, {2}, {3}}
+	slots := map[common.Hash256]uint64{roots[0]: 1, roots[1]: 2, roots[2]: 3}
+	agor := NewAttestationsAggregator(func(blockHash common.Hash256) (uint64, bool) {
+		slot, ok := slots[blockHash]
+		return slot, ok
+	}, shards)
+	return agor, roots
+}
+
+func TestEquivocationOutOfOrder(t *testing.T) {
+	agor, roots := testAggregator(2)
+	// a vote for slot 1, then a later vote, then a conflicting vote for slot 1: the latest message is not for slot 1.
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[0], Attester: 5, Slot: 1, Weight: 10})
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[2], Attester: 5, Slot: 3, Weight: 10})
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[1], Attester: 5, Slot: 1, Weight: 10})
+	if eq := agor.EquivocatingValidators(); len(eq) != 1 || eq[0] != 5 {
+		t.Fatalf("expected validator 5 to be equivocating, got %v", eq)
+	}
+	if _, ok := agor.LatestMessage(5); ok {
+		t.Fatal("the latest message of an equivocating validator should be removed")
+	}
+	if w := agor.Weights()[roots[2]]; w != 0 {
+		t.Fatalf("expected the weight of the equivocating validator to be removed, got %d", w)
+	}
+}
+
+func TestSameVoteIsNotEquivocation(t *testing.T) {
+	agor, roots := testAggregator(1)
+	at := &attestation.Attestation{BeaconBlockRoot: roots[0], Attester: 1, Slot: 1, Weight: 10}
+	agor.AttestationIn(at)
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[1], Attester: 1, Slot: 2, Weight: 10})
+	agor.AttestationIn(at)
+	if eq := agor.EquivocatingValidators(); len(eq) != 0 {
+		t.Fatalf("expected no equivocators, got %v", eq)
+	}
+	if w := agor.Weights()[roots[1]]; w != 10 {
+		t.Fatalf("expected the latest vote to count, got weight %d", w)
+	}
+}
+
+func TestPrunedVotesAreForgotten(t *testing.T) {
+	agor, roots := testAggregator(1)
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[0], Attester: 1, Slot: 1, Weight: 10})
+	agor.PruneVotes(2)
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[1], Attester: 1, Slot: 1, Weight: 10})
+	if eq := agor.EquivocatingValidators(); len(eq) != 0 {
+		t.Fatalf("votes before the pruned slot should not be checked, got equivocators %v", eq)
+	}
+}
+
+// Votes of aggregates and single votes are recorded alike: a conflict is detected in either order.
+func TestEquivocationInAggregate(t *testing.T) {
+	agor, roots := testAggregator(2)
+	agor.AggregateIn(roots[0], 1, []common.ValidatorID{1, 2, 3, 4}, []uint64{10, 10, 10, 10})
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[1], Attester: 2, Slot: 1, Weight: 10})
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[1], Attester: 5, Slot: 1, Weight: 10})
+	// a conflicting aggregate, and a repeated one
+	agor.AggregateIn(roots[2], 1, []common.ValidatorID{3, 5}, []uint64{10, 10})
+	agor.AggregateIn(roots[0], 1, []common.ValidatorID{1, 4}, []uint64{10, 10})
+	if eq := agor.EquivocatingValidators(); len(eq) != 3 || eq[0] != 2 || eq[1] != 3 || eq[2] != 5 {
+		t.Fatalf("expected validators 2, 3 and 5 to be equivocating, got %v", eq)
+	}
+	weights := agor.Weights()
+	if weights[roots[0]] != 20 || weights[roots[1]] != 0 || weights[roots[2]] != 0 {
+		t.Fatalf("expected only the votes of validators 1 and 4 to count, got %v", weights)
+	}
+}
+
+func TestRemoveAfterCleanup(t *testing.T) {
+	agor, roots := testAggregator(1)
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[0], Attester: 1, Slot: 1, Weight: 10})
+	agor.TakeDeltas()
+	// the aggregate is processed, cleanup removes it, while the latest message is still there.
+	agor.Cleanup()
+	agor.UpdateWeight(1, 20)
+	agor.ExpireAttestations(1)
+	agor.RemoveLatest(1)
+	agor.ExpireAttestations(2)
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[1], Attester: 2, Slot: 2, Weight: 10})
+	agor.TakeDeltas()
+	agor.Cleanup()
+	agor.AttestationIn(&attestation.Attestation{BeaconBlockRoot: roots[2], Attester: 2, Slot: 3, Weight: 10})
+	if w := agor.Weights()[roots[2]]; w != 10 {
+		t.Fatalf("expected the vote to move to the new target, got weight %d", w)
+	}
+}
+
+// A batch with a vote of every validator, every op: the votes move between 16 targets.
+// The speed-up with more shards depends on the amount of cores (see GOMAXPROCS).
+// With GOMAXPROCS 1 the shards are processed by the calling goroutine.
+func BenchmarkAttestationsInShards(b *testing.B) {
+	const validators = 1 << 14
+	roots := make([]common.Hash256, 16)
+	for i := range roots {
+		roots[i] = common.Hash256{uint8(i + 1)}
+	}
+	cases := []struct {
+		shards int
+		// 0 to keep the current GOMAXPROCS
+		procs int
+	}{{1, 0}, {2, 0}, {4, 0}, {8, 0}, {8, 1}}
+	for _, c := range cases {
+		name := fmt.Sprintf("shards_%d", c.shards)
+		if c.procs != 0 {
+			name += fmt.Sprintf("_procs_%d", c.procs)
+		}
+		shards, procs := c.shards, c.procs
+		b.Run(name, func(b *testing.B) {
+			if procs != 0 {
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+			}
+			agor := NewAttestationsAggregator(func(blockHash common.Hash256) (uint64, bool) {
+				return 1, true
+			}, shards)
+			ats := make([]*attestation.Attestation, validators)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				slot := uint64(i + 1)
+				for id := range ats {
+					ats[id] = &attestation.Attestation{BeaconBlockRoot: roots[(i + id) % len(roots)],
+						Attester: common.ValidatorID(id), Slot: slot, Weight: 10}
+				}
+				// only the conflicts with the current slot have to be detected
+				agor.PruneVotes(slot)
+				b.StartTimer()
+				agor.AttestationsIn(ats)
+				agor.TakeDeltas()
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package attestations
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/common"
+)
+
+/// Attestations for blocks that are not known (yet), keyed by the missing block root.
+/// They are replayed when the block arrives. A vote (attester, slot and block) is kept only once.
+type PendingPool struct {
+
+	byRoot map[common.Hash256][]*attestation.Attestation
+
+	// the votes in the pool, to detect resent attestations
+	votes map[pendingVote]struct{}
+
+	count uint64
+
+	// Maximum amount of pending attestations, new attestations are dropped when the pool is full.
+	Limit uint64
+
+	// Attestations that waited this amount of slots (after the slot of the attestation) are dropped.
+	ExpirySlots uint64
+
+	// Counters, for monitoring: added to the pool, replayed when the block arrived,
+	//  expired before the block arrived, dropped because the pool was full, and ignored because they were in the pool already.
+	Added uint64
+	Replayed uint64
+	Expired uint64
+	Dropped uint64
+	Duplicates uint64
+}
+
+type pendingVote struct {
+	attester common.ValidatorID
+	slot uint64
+	root common.Hash256
+}
+
+func voteOf(at *attestation.Attestation) pendingVote {
+	return pendingVote{attester: at.Attester, slot: at.Slot, root: at.BeaconBlockRoot}
+}
+
+func NewPendingPool(limit uint64, expirySlots uint64) *PendingPool {
+	res := &PendingPool{
+		byRoot: make(map[common.Hash256][]*attestation.Attestation),
+		votes: make(map[pendingVote]struct{}),
+		Limit: limit,
+		ExpirySlots: expirySlots,
+	}
+	return res
+}
+
+/// Adds the attestation to the pool. Returns false if it was not added:
+///  the same vote is in the pool already, or the pool is full and it was dropped.
+func (pp *PendingPool) Add(at *attestation.Attestation) bool {
+	if pp.Has(at) {
+		pp.Duplicates++
+		return false
+	}
+	if pp.count >= pp.Limit {
+		pp.Dropped++
+		return false
+	}
+	pp.byRoot[at.BeaconBlockRoot] = append(pp.byRoot[at.BeaconBlockRoot], at)
+	pp.votes[voteOf(at)] = struct{}{}
+	pp.count++
+	pp.Added++
+	return true
+}
+
+/// Removes and returns all pending attestations for the block, in the order they were added.
+func (pp *PendingPool) Take(blockHash common.Hash256) []*attestation.Attestation {
+	res, ok := pp.byRoot[blockHash]
+	if !ok {
+		return nil
+	}
+	delete(pp.byRoot, blockHash)
+	for _, at := range res {
+		delete(pp.votes, voteOf(at))
+	}
+	pp.count -= uint64(len(res))
+	pp.Replayed += uint64(len(res))
+	return res
+}
+
+/// Drops all attestations that waited too long, at the given (current) slot.
+func (pp *PendingPool) Expire(slot uint64) {
+	for k, ats := range pp.byRoot {
+		remaining := ats[:0]
+		for _, at := range ats {
+			if at.Slot + pp.ExpirySlots < slot {
+				pp.Expired++
+				pp.count--
+				delete(pp.votes, voteOf(at))
+			} else {
+				remaining = append(remaining, at)
+			}
+		}
+		if len(remaining) == 0 {
+			// deletion during map iteration, safe in Go
+			delete(pp.byRoot, k)
+		} else {
+			pp.byRoot[k] = remaining
+		}
+	}
+}
+
+/// Checks if the same vote (attester, slot and block) is in the pool.
+func (pp *PendingPool) Has(at *attestation.Attestation) bool {
+	_, ok := pp.votes[voteOf(at)]
+	return ok
+}
+
+/// The amount of pending attestations.
+func (pp *PendingPool) Len() uint64 {
+	return pp.count
+}
+
+/// The amount of distinct missing blocks that attestations are waiting for.
+func (pp *PendingPool) MissingBlocks() int {
+	return len(pp.byRoot)
+}
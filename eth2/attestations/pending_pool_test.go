@@ -0,0 +1,37 @@
+package attestations
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/common"
+	"testing"
+)
+
+func TestPendingDuplicates(t *testing.T) {
+	pp := NewPendingPool(10, 1)
+	at := &attestation.Attestation{BeaconBlockRoot: common.Hash256{1}, Attester: 1, Slot: 5, Weight: 10}
+	if !pp.Add(at) {
+		t.Fatal("expected the attestation to be added")
+	}
+	resent := *at
+	if pp.Add(&resent) {
+		t.Fatal("expected the resent attestation to be ignored")
+	}
+	// another slot is another vote
+	if !pp.Add(&attestation.Attestation{BeaconBlockRoot: common.Hash256{1}, Attester: 1, Slot: 6, Weight: 10}) {
+		t.Fatal("expected the vote for another slot to be added")
+	}
+	if pp.Len() != 2 || pp.Duplicates != 1 {
+		t.Fatalf("expected 2 pending attestations and 1 duplicate, got %d and %d", pp.Len(), pp.Duplicates)
+	}
+	if res := pp.Take(common.Hash256{1}); len(res) != 2 {
+		t.Fatalf("expected 2 attestations to be replayed, got %d", len(res))
+	}
+	// replayed votes are forgotten, the pool accepts them again
+	if !pp.Add(at) {
+		t.Fatal("expected the attestation to be added again after it was replayed")
+	}
+	pp.Expire(7)
+	if pp.Has(at) || !pp.Add(at) {
+		t.Fatal("expected the expired attestation to be forgotten")
+	}
+}
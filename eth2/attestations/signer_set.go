@@ -0,0 +1,69 @@
+package attestations
+
+import (
+	"lmd-ghost/eth2/common"
+	"math/bits"
+)
+
+/// Set of validators, as a bitfield indexed by validator ID.
+/// The bitfield grows with the highest ID in the set, and is released when the set becomes empty,
+///  so aggregates that lost all their votes do not keep it around.
+type SignerSet struct {
+
+	bits []uint64
+
+	count uint64
+}
+
+func (s *SignerSet) Has(id common.ValidatorID) bool {
+	i := uint64(id) >> 6
+	return i < uint64(len(s.bits)) && s.bits[i] & (1 << (uint64(id) & 63)) != 0
+}
+
+/// Adds the validator, returns false if it was in the set already.
+func (s *SignerSet) Add(id common.ValidatorID) bool {
+	i := uint64(id) >> 6
+	if i >= uint64(len(s.bits)) {
+		grown := make([]uint64, i + 1, i + 1 + i / 4)
+		copy(grown, s.bits)
+		s.bits = grown
+	}
+	bit := uint64(1) << (uint64(id) & 63)
+	if s.bits[i] & bit != 0 {
+		return false
+	}
+	s.bits[i] |= bit
+	s.count++
+	return true
+}
+
+/// Removes the validator, returns false if it was not in the set.
+func (s *SignerSet) Remove(id common.ValidatorID) bool {
+	if !s.Has(id) {
+		return false
+	}
+	s.bits[uint64(id) >> 6] &^= 1 << (uint64(id) & 63)
+	s.count--
+	if s.count == 0 {
+		s.bits = nil
+	}
+	return true
+}
+
+func (s *SignerSet) Count() uint64 {
+	return s.count
+}
+
+/// All validators in the set, sorted by ID.
+func (s *SignerSet) IDs() []common.ValidatorID {
+	res := make([]common.ValidatorID, 0, s.count)
+	for i, word := range s.bits {
+		for word != 0 {
+			j := bits.TrailingZeros64(word)
+			res = append(res, common.ValidatorID(i << 6 + j))
+			// clear the lowest set bit
+			word &= word - 1
+		}
+	}
+	return res
+}
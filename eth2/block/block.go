@@ -14,6 +14,12 @@ type BeaconBlock struct {
 
 	Slot uint64
 
+	// Checkpoints of the post-state of the block.
+	// In a real client these would be part of the state.
+	JustifiedCheckpoint common.Checkpoint
+
+	FinalizedCheckpoint common.Checkpoint
+
 	// Lots of other stuff from the spec could be added here.
 
 }
@@ -2,17 +2,29 @@ package chain
 
 import (
 	"errors"
+	"fmt"
 	"lmd-ghost/eth2/attestations/attestation"
 	"lmd-ghost/eth2/block"
 	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
 	"lmd-ghost/eth2/dag"
+	"lmd-ghost/eth2/data/validator"
 	"lmd-ghost/eth2/storage"
+	"sync"
 )
 
+/// The methods of the chain are safe for concurrent use.
+/// The Dag and Registry are not: use them directly only when no other goroutine is calling into the chain.
 type BeaconChain struct {
 
-	// Access other most-current variables through storage or dag, using head as reference.
-	Head      common.Hash256
+	// Guards the dag, the registry and the slot. Changes are serialized, the fork-choice rules are single-threaded.
+	lock      sync.RWMutex
+
+	// Guards the head separately, so reading it does not wait for the fork-choice.
+	headLock  sync.RWMutex
+
+	// Access other most-current variables through storage or dag, using head as reference. See Head.
+	head      common.Hash256
 
 	// The inner-source of continuously-changing truth: the data stored within and between (i.e. state) the blocks.
 	Storage    *storage.BeaconStorage
@@ -20,13 +32,26 @@ type BeaconChain struct {
 	// The outer-source of continuously-changing truth: the collection of blocks, structured.
 	Dag        *dag.BeaconDag
 
+	// The validators, the effective balances of the active validators are the weights of their attestations.
+	Registry   *validator.Registry
+
+	// The current slot, by the clock (see OnSlot). Attestations for later slots are rejected.
+	Slot       uint64
+
 }
 
 func NewBeaconChain(genesisBlock *block.BeaconBlock, initForkChoice dag.InitForkChoice) (*BeaconChain, error) {
 	res := &BeaconChain{
-		Head: genesisBlock.Hash,
+		head: genesisBlock.Hash,
 		Storage: storage.NewBeaconStorage(),
 		Dag: dag.NewBeaconDag(initForkChoice),
+		Registry: validator.NewRegistry(genesisBlock.Slot / constants.EPOCH_LENGTH),
+		Slot: genesisBlock.Slot,
+	}
+	res.Dag.SetWeightLookup(res.Registry.ActiveBalance)
+	// orphans are stored when they arrive: forget those that are dropped, so they can be sent again.
+	res.Dag.OrphanDropped = func(bl *block.BeaconBlock) {
+		_ = res.Storage.DeleteBlock(bl.Hash)
 	}
 	if err := res.Storage.PutBlock(genesisBlock); err != nil {
 		return nil, err
@@ -35,11 +60,21 @@ func NewBeaconChain(genesisBlock *block.BeaconBlock, initForkChoice dag.InitFork
 	//if err := res.Storage.PutPostState(genesisBlock.Hash, genesisState); err != nil {
 	//	return nil, err
 	//}
-	res.Dag.BlockIn(genesisBlock)
+	if _, err := res.Dag.BlockIn(genesisBlock); err != nil {
+		return nil, err
+	}
 	return res, nil
 }
 
-func (ch *BeaconChain) BlockIn(block *block.BeaconBlock) error {
+/// Adds the block to the chain. Blocks with an unknown parent are queued as orphans, see BeaconDag.BlockIn.
+/// Returns BlockRejected and one of the Err* values of this package if the block is rejected, a rejected block changes nothing.
+/// If the block was imported, but the head could not be updated, BlockImported is returned with the error.
+func (ch *BeaconChain) BlockIn(block *block.BeaconBlock) (dag.ImportResult, error) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if err := ch.validateBlock(block); err != nil {
+		return dag.BlockRejected, err
+	}
 	// For a real implementation:
 	//// preparation
 	//// ======================
@@ -75,27 +110,349 @@ func (ch *BeaconChain) BlockIn(block *block.BeaconBlock) error {
 	//
 	// save the block and the state
 	if err := ch.Storage.PutBlock(block); err != nil {
-		return errors.New("failed to save processed block to storage")
+		return dag.BlockRejected, errors.New("failed to save processed block to storage")
 	}
 	//if err := ch.Storage.PutPostState(block.Hash, st); err != nil {
 	//	return errors.New("failed to save processed block to storage")
 	//}
 
-	ch.Dag.BlockIn(block)
+	res, err := ch.Dag.BlockIn(block)
+	if res == dag.BlockRejected {
+		// the dag is unchanged, forget the block, so it can be sent again.
+		_ = ch.Storage.DeleteBlock(block.Hash)
+	}
+	if err != nil {
+		return res, err
+	}
+
+	if res == dag.BlockImported {
+		if err := ch.updateHead(); err != nil {
+			return res, err
+		}
+	}
 
-	ch.UpdateHead()
+	return res, nil
+}
 
+// Checks the block against the blocks that are known, and the finalized checkpoint.
+func (ch *BeaconChain) validateBlock(bl *block.BeaconBlock) error {
+	// the storage also has the orphans, and blocks that were pruned from the dag.
+	if known, _ := ch.Storage.GetBlock(bl.Hash); known != nil {
+		return ErrDuplicateBlock
+	}
+	if bl.Slot <= ch.Dag.Finalized.Slot {
+		return ErrConflictsWithFinality
+	}
+	if bl.FinalizedCheckpoint.Epoch > bl.JustifiedCheckpoint.Epoch || bl.JustifiedCheckpoint.Epoch > bl.Slot / constants.EPOCH_LENGTH {
+		return ErrInvalidCheckpoints
+	}
+	if parent, _ := ch.Storage.GetBlock(bl.ParentHash); parent != nil && bl.Slot <= parent.Slot {
+		return ErrSlotNotAfterParent
+	}
+	if parentNode, ok := ch.Dag.Nodes[bl.ParentHash]; ok && !dag.IsAncestor(ch.Dag.Finalized, parentNode) {
+		return ErrConflictsWithFinality
+	}
+	// missing here: state transition, see BlockIn
 	return nil
 }
 
-func (ch *BeaconChain) AttestationIn(attestation *attestation.Attestation) error {
-	// missing here: verify attestation
+/// The result of adding an attestation (or aggregate) to the chain.
+type AttestationResult uint8
+
+const (
+	// The votes are processed: they count for the block, unless the attester has a later latest message.
+	AttestationAccepted AttestationResult = iota
+	// The block of the attestation is not known (yet). The attestation is not dropped:
+	//  it waits in the pending pool of the dag, and counts when the block arrives.
+	AttestationPending
+	// The attestation was not added, see the error that is returned with it.
+	AttestationRejected
+)
+
+func (r AttestationResult) String() string {
+	switch r {
+	case AttestationAccepted:
+		return "accepted"
+	case AttestationPending:
+		return "pending"
+	case AttestationRejected:
+		return "rejected"
+	default:
+		return "unknown attestation result"
+	}
+}
+
+// Accepted, or pending if the block is not known, after the votes were added to the dag.
+func (ch *BeaconChain) addedResult(blockRoot common.Hash256) AttestationResult {
+	if _, ok := ch.Dag.Nodes[blockRoot]; !ok {
+		return AttestationPending
+	}
+	return AttestationAccepted
+}
+
+/// Adds the attestation, the weight is the effective balance of the attester, the weight of the attestation is ignored.
+/// Returns AttestationRejected and one of the Err* values of this package if the attestation is rejected.
+/// Attestations for an unknown block are kept until the block arrives, AttestationPending is returned for those.
+func (ch *BeaconChain) AttestationIn(attestation *attestation.Attestation) (AttestationResult, error) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if err := ch.checkAttestation(attestation); err != nil {
+		return AttestationRejected, err
+	}
 	// real implementation would save the attestation, for later slashing etc.
 	ch.Dag.AttestationIn(attestation)
+	return ch.addedResult(attestation.BeaconBlockRoot), nil
+}
+
+/// Adds the attestations in one batch, e.g. when replaying attestations. Large batches are processed in parallel.
+/// Returns a result and an error per attestation, like AttestationIn: the errors are nil for the attestations that were not rejected.
+/// Note: duplicates within the batch are not detected, they are no-ops.
+func (ch *BeaconChain) AttestationsIn(ats []*attestation.Attestation) ([]AttestationResult, []error) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	results := make([]AttestationResult, len(ats))
+	errs := make([]error, len(ats))
+	accepted := make([]*attestation.Attestation, 0, len(ats))
+	for i, at := range ats {
+		if errs[i] = ch.checkAttestation(at); errs[i] == nil {
+			accepted = append(accepted, at)
+		} else {
+			results[i] = AttestationRejected
+		}
+	}
+	ch.Dag.AttestationsIn(accepted)
+	for i, at := range ats {
+		if errs[i] == nil {
+			results[i] = ch.addedResult(at.BeaconBlockRoot)
+		}
+	}
+	return results, errs
+}
+
+// Checks the attester and the vote, see AttestationIn.
+func (ch *BeaconChain) checkAttestation(attestation *attestation.Attestation) error {
+	if _, ok := ch.Registry.Get(attestation.Attester); !ok {
+		return ErrUnknownValidator
+	}
+	if !ch.Registry.IsActive(attestation.Attester) {
+		return ErrInactiveValidator
+	}
+	if err := ch.checkVote(attestation.BeaconBlockRoot, attestation.Slot); err != nil {
+		return err
+	}
+	if latest, ok := ch.Dag.LatestMessage(attestation.Attester); ok &&
+		latest.Slot == attestation.Slot && latest.BeaconBlockRoot == attestation.BeaconBlockRoot {
+		return ErrDuplicateAttestation
+	}
+	if _, ok := ch.Dag.Nodes[attestation.BeaconBlockRoot]; !ok && ch.Dag.PendingAttestations().Has(attestation) {
+		// resent while waiting for the block
+		return ErrDuplicateAttestation
+	}
+	// missing here: verify signature
+	return nil
+}
+
+// Checks the slot of a vote, and its block (if known), against the clock and the finalized checkpoint.
+func (ch *BeaconChain) checkVote(blockRoot common.Hash256, slot uint64) error {
+	if slot > ch.Slot {
+		return ErrFutureSlot
+	}
+	if slot < ch.Dag.FinalizedCheckpoint.Epoch * constants.EPOCH_LENGTH {
+		return ErrBeforeFinalized
+	}
+	if node, ok := ch.Dag.Nodes[blockRoot]; ok && node.Slot < ch.Dag.Finalized.Slot {
+		return ErrBeforeFinalized
+	}
+	return nil
+}
+
+/// Adds the aggregate attestation of a committee: the participants, marked in the aggregation bits,
+///  are looked up in the committee assignments, and their votes are added in one batch.
+/// Like AttestationIn, the weights are the effective balances of the attesters, and the result tells if the votes are pending.
+func (ch *BeaconChain) AggregateAttestationIn(agg *attestation.AggregateAttestation) (AttestationResult, error) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if err := ch.checkVote(agg.BeaconBlockRoot, agg.Slot); err != nil {
+		return AttestationRejected, err
+	}
+	attesters, weights, err := ch.expandAggregate(agg)
+	if err != nil {
+		return AttestationRejected, err
+	}
+	// missing here: verify aggregate signature
+	// Note: aggregates overlap, votes that are already the latest message are not an error.
+	ch.Dag.AggregateIn(agg.BeaconBlockRoot, agg.Slot, attesters, weights)
+	return ch.addedResult(agg.BeaconBlockRoot), nil
+}
+
+/// The participants of the aggregate, with their weights. Participants that are not active anymore are left out.
+func (ch *BeaconChain) ExpandAggregate(agg *attestation.AggregateAttestation) ([]common.ValidatorID, []uint64, error) {
+	// not a read lock: the committees are computed when first needed
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.expandAggregate(agg)
+}
+
+func (ch *BeaconChain) expandAggregate(agg *attestation.AggregateAttestation) ([]common.ValidatorID, []uint64, error) {
+	committee, err := ch.Registry.Committee(agg.Slot, agg.CommitteeIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	participants, err := agg.Participants(len(committee))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(participants) == 0 {
+		return nil, nil, fmt.Errorf("aggregate attestation of committee %d in slot %d has no participants", agg.CommitteeIndex, agg.Slot)
+	}
+	epoch := ch.Registry.Epoch()
+	attesters := make([]common.ValidatorID, 0, len(participants))
+	weights := make([]uint64, 0, len(participants))
+	for _, i := range participants {
+		// the committee has the validators themselves, no need to look up the weights
+		if v := committee[i]; v.IsActive(epoch) {
+			attesters = append(attesters, v.Id)
+			weights = append(weights, v.EffectiveBalance())
+		}
+	}
+	return attesters, weights, nil
+}
+
+/// Changes the balance of the validator.
+/// If its effective balance changed, the weight of its latest message changes with it, and the head is updated.
+func (ch *BeaconChain) SetBalance(id common.ValidatorID, balance uint64) error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	changed, err := ch.Registry.SetBalance(id, balance)
+	if err != nil {
+		return err
+	}
+	// inactive validators have no latest message that counts
+	if weight, active := ch.Registry.ActiveBalance(id); changed && active {
+		ch.Dag.UpdateValidatorWeight(id, weight)
+		return ch.updateHead()
+	}
+	return nil
+}
+
+/// Changes the justified checkpoint, and updates the head.
+func (ch *BeaconChain) Justify(cp common.Checkpoint) error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if err := ch.Dag.Justify(cp); err != nil {
+		return err
+	}
+	return ch.updateHead()
+}
+
+/// Changes the finalized checkpoint, prunes the dag, and updates the head.
+func (ch *BeaconChain) Finalize(cp common.Checkpoint) error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if err := ch.Dag.Finalize(cp); err != nil {
+		return err
+	}
+	return ch.updateHead()
+}
+
+/// Starts the given slot: votes may expire, depending on the fork-choice rule.
+/// At the start of an epoch validators may activate or exit, the latest messages of exited validators stop counting.
+/// Updates the head.
+func (ch *BeaconChain) OnSlot(slot uint64) error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if slot > ch.Slot {
+		ch.Slot = slot
+	}
+	_, exited := ch.Registry.SetEpoch(slot / constants.EPOCH_LENGTH)
+	for _, id := range exited {
+		ch.Dag.RemoveValidatorVote(id)
+	}
+	ch.Dag.OnSlot(slot)
+	return ch.updateHead()
+}
+
+/// Excludes the block and its descendants from the head, e.g. when a later check of the block failed.
+func (ch *BeaconChain) InvalidateBlock(blockHash common.Hash256) error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if err := ch.Dag.InvalidateBlock(blockHash); err != nil {
+		return err
+	}
+	return ch.updateHead()
+}
+
+/// Validators that have been found equivocating, for slashing.
+func (ch *BeaconChain) EquivocatingValidators() []common.ValidatorID {
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	return ch.Dag.EquivocatingValidators()
+}
+
+/// The validators whose latest message votes for the block itself, sorted by ID. To explain fork-choice decisions.
+func (ch *BeaconChain) Voters(blockHash common.Hash256) ([]common.ValidatorID, error) {
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	if _, ok := ch.Dag.Nodes[blockHash]; !ok {
+		return nil, fmt.Errorf("unknown block %s", blockHash)
+	}
+	return ch.Dag.Voters(blockHash), nil
+}
+
+/// The part of the fork-choice weight of the block that comes from the given validators,
+///  i.e. their latest votes for the block and its descendants.
+func (ch *BeaconChain) WeightFrom(blockHash common.Hash256, validators []common.ValidatorID) (int64, error) {
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	node, ok := ch.Dag.Nodes[blockHash]
+	if !ok {
+		return 0, fmt.Errorf("unknown block %s", blockHash)
+	}
+	return ch.Dag.WeightFrom(node, validators), nil
+}
+
+/// Boosts a timely block, until the boost is expired (the next slot).
+func (ch *BeaconChain) ApplyProposerBoost(blockHash common.Hash256, committeeWeight uint64) error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.Dag.ApplyProposerBoost(blockHash, committeeWeight)
+	return ch.updateHead()
+}
+
+func (ch *BeaconChain) ExpireProposerBoost() error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.Dag.ExpireProposerBoost()
+	return ch.updateHead()
+}
+
+/// Determines the head. The head does not change if the fork-choice rule returns an error.
+func (ch *BeaconChain) UpdateHead() error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.updateHead()
+}
+
+// Like UpdateHead, for callers that hold the lock already.
+func (ch *BeaconChain) updateHead() error {
+	head, err := ch.Dag.HeadFn()
+	if err != nil {
+		return err
+	}
+	ch.headLock.Lock()
+	ch.head = head
+	ch.headLock.Unlock()
 	return nil
 }
 
-func (ch *BeaconChain) UpdateHead() {
-	// determine the head
-	ch.Head = ch.Dag.HeadFn()
+/// The head, as of the last update. Does not wait for changes in progress.
+func (ch *BeaconChain) Head() common.Hash256 {
+	ch.headLock.RLock()
+	defer ch.headLock.RUnlock()
+	return ch.head
+}
+
+/// The block with the given hash, or nil if it is not known. Like Head, does not wait for changes in progress.
+func (ch *BeaconChain) GetBlock(blockHash common.Hash256) (*block.BeaconBlock, error) {
+	return ch.Storage.GetBlock(blockHash)
 }
\ No newline at end of file
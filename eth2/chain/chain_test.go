@@ -0,0 +1,344 @@
+package chain
+
+import (
+	"errors"
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"lmd-ghost/eth2/data/validator"
+	"lmd-ghost/eth2/fork_choice/choices/proto_array"
+	"testing"
+)
+
+var genesisCp = common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+
+// A chain with just the genesis block, and the given amount of validators, active from genesis.
+func testChain(tb testing.TB, validators int) *BeaconChain {
+	return testChainWith(tb, validators, proto_array.NewProtoArrayLMDGhost)
+}
+
+// Like testChain, with the given fork-choice rule.
+func testChainWith(tb testing.TB, validators int, initForkChoice dag.InitForkChoice) *BeaconChain {
+	genesis := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	ch, err := NewBeaconChain(genesis, initForkChoice)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < validators; i++ {
+		v := validator.NewValidator(common.ValidatorID(i), constants.MAX_EFFECTIVE_BALANCE, constants.GENESIS_EPOCH)
+		if err := ch.Registry.Add(v); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return ch
+}
+
+// Every slot, all committees vote for the genesis block: as aggregates, or one vote at a time.
+// (16384 validators: 256 votes per slot, per op)
+func BenchmarkAggregateAttestationIn(b *testing.B) {
+	run := func(b *testing.B, aggregated bool) {
+		ch := testChain(b, 1 << 14)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			slot := constants.GENESIS_SLOT + uint64(i)
+			if err := ch.OnSlot(slot); err != nil {
+				b.Fatal(err)
+			}
+			count, err := ch.Registry.CommitteeCount(slot)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var aggs []*attestation.AggregateAttestation
+			var ats []*attestation.Attestation
+			for index := uint64(0); index < count; index++ {
+				committee, err := ch.Registry.Committee(slot, index)
+				if err != nil {
+					b.Fatal(err)
+				}
+				agg := attestation.NewAggregateAttestation(genesisCp.Root, slot, index, len(committee))
+				for j, v := range committee {
+					agg.SetParticipant(j)
+					ats = append(ats, &attestation.Attestation{BeaconBlockRoot: genesisCp.Root, Attester: v.Id, Slot: slot})
+				}
+				aggs = append(aggs, agg)
+			}
+			b.StartTimer()
+			if aggregated {
+				for _, agg := range aggs {
+					if _, err := ch.AggregateAttestationIn(agg); err != nil {
+						b.Fatal(err)
+					}
+				}
+			} else {
+				for _, at := range ats {
+					if _, err := ch.AttestationIn(at); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		}
+	}
+	b.Run("aggregates", func(b *testing.B) {
+		run(b, true)
+	})
+	b.Run("per_vote", func(b *testing.B) {
+		run(b, false)
+	})
+}
+
+func TestResentPendingAttestation(t *testing.T) {
+	ch := testChain(t, 4)
+	at := &attestation.Attestation{BeaconBlockRoot: common.Hash256{9}, Attester: 1, Slot: constants.GENESIS_SLOT}
+	if res, err := ch.AttestationIn(at); err != nil || res != AttestationPending {
+		t.Fatalf("expected the attestation to be %s, got %s %v", AttestationPending, res, err)
+	}
+	resent := *at
+	if res, err := ch.AttestationIn(&resent); err != ErrDuplicateAttestation || res != AttestationRejected {
+		t.Fatalf("expected %s %v, got %s %v", AttestationRejected, ErrDuplicateAttestation, res, err)
+	}
+	if n := ch.Dag.PendingAttestations().Len(); n != 1 {
+		t.Fatalf("expected 1 pending attestation, got %d", n)
+	}
+}
+
+// Kept and rejected attestations are told apart by their result, in a batch and as aggregates.
+func TestAttestationResults(t *testing.T) {
+	ch := testChain(t, 4 * int(constants.EPOCH_LENGTH))
+	slot := constants.GENESIS_SLOT
+	unknown := &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{2}, Slot: slot + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	ats := []*attestation.Attestation{
+		{BeaconBlockRoot: genesisCp.Root, Attester: 1, Slot: slot},
+		{BeaconBlockRoot: unknown.Hash, Attester: 2, Slot: slot},
+		{BeaconBlockRoot: genesisCp.Root, Attester: 1 << 20, Slot: slot},
+		{BeaconBlockRoot: genesisCp.Root, Attester: 3, Slot: slot + 1},
+	}
+	expected := []AttestationResult{AttestationAccepted, AttestationPending, AttestationRejected, AttestationRejected}
+	expectedErrs := []error{nil, nil, ErrUnknownValidator, ErrFutureSlot}
+	results, errs := ch.AttestationsIn(ats)
+	for i := range ats {
+		if results[i] != expected[i] || errs[i] != expectedErrs[i] {
+			t.Errorf("attestation %d: expected %s %v, got %s %v", i, expected[i], expectedErrs[i], results[i], errs[i])
+		}
+	}
+
+	committee, err := ch.Registry.Committee(slot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agg := attestation.NewAggregateAttestation(unknown.Hash, slot, 0, len(committee))
+	agg.SetParticipant(0)
+	if res, err := ch.AggregateAttestationIn(agg); err != nil || res != AttestationPending {
+		t.Fatalf("expected the aggregate to be %s, got %s %v", AttestationPending, res, err)
+	}
+	future := attestation.NewAggregateAttestation(genesisCp.Root, slot + 1, 0, len(committee))
+	future.SetParticipant(0)
+	if res, err := ch.AggregateAttestationIn(future); err != ErrFutureSlot || res != AttestationRejected {
+		t.Fatalf("expected %s %v, got %s %v", AttestationRejected, ErrFutureSlot, res, err)
+	}
+	// the pending votes count when the block arrives
+	if err := ch.OnSlot(unknown.Slot); err != nil {
+		t.Fatal(err)
+	}
+	blockIn(t, ch, unknown)
+	voters, err := ch.Voters(unknown.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(voters) != 2 {
+		t.Fatalf("expected the pending attestation and aggregate to count, got voters %v", voters)
+	}
+}
+
+func blockIn(t *testing.T, ch *BeaconChain, b *block.BeaconBlock) {
+	if res, err := ch.BlockIn(b); err != nil || res != dag.BlockImported {
+		t.Fatalf("block %s not imported: %s %v", b.Hash, res, err)
+	}
+}
+
+// The stored block, the nodes of the dag (and their children), the checkpoints, and the head,
+//  as known to the chain and as computed by the fork-choice rule, to check that a rejected block changes nothing.
+type chainSnapshot struct {
+	stored *block.BeaconBlock
+	nodes map[common.Hash256]*dag.DagNode
+	children map[common.Hash256]int
+	justified, finalized common.Checkpoint
+	head, ruleHead common.Hash256
+}
+
+func snapshot(t *testing.T, ch *BeaconChain, blockHash common.Hash256) chainSnapshot {
+	stored, _ := ch.Storage.GetBlock(blockHash)
+	nodes := make(map[common.Hash256]*dag.DagNode, len(ch.Dag.Nodes))
+	children := make(map[common.Hash256]int, len(ch.Dag.Nodes))
+	for k, v := range ch.Dag.Nodes {
+		nodes[k] = v
+		children[k] = len(v.Children)
+	}
+	ruleHead, err := ch.Dag.HeadFn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chainSnapshot{stored: stored, nodes: nodes, children: children,
+		justified: ch.Dag.JustifiedCheckpoint, finalized: ch.Dag.FinalizedCheckpoint, head: ch.Head(), ruleHead: ruleHead}
+}
+
+func (a chainSnapshot) equals(b chainSnapshot) bool {
+	if a.stored != b.stored || a.head != b.head || a.ruleHead != b.ruleHead ||
+		a.justified != b.justified || a.finalized != b.finalized || len(a.nodes) != len(b.nodes) {
+		return false
+	}
+	for k, v := range a.nodes {
+		if b.nodes[k] != v || b.children[k] != a.children[k] {
+			return false
+		}
+	}
+	return true
+}
+
+var errRuleRejects = errors.New("rejected by the fork-choice rule")
+
+// A fork-choice rule that fails to add the given blocks, and leaves its state unchanged then.
+type rejectingRule struct {
+	dag.ForkChoice
+	reject map[common.Hash256]bool
+}
+
+func (r *rejectingRule) OnNewNode(node *dag.DagNode) error {
+	if r.reject[node.Key] {
+		return errRuleRejects
+	}
+	return r.ForkChoice.OnNewNode(node)
+}
+
+func rejectingChain(t *testing.T, reject ...common.Hash256) *BeaconChain {
+	return testChainWith(t, 4, func(d *dag.BeaconDag) dag.ForkChoice {
+		r := &rejectingRule{ForkChoice: proto_array.NewProtoArrayLMDGhost(d), reject: make(map[common.Hash256]bool)}
+		for _, h := range reject {
+			r.reject[h] = true
+		}
+		return r
+	})
+}
+
+func TestRejectedBlocks(t *testing.T) {
+	// g <- f (finalized) <- a, and g <- s: a sibling of f, after it, that stays in the dag.
+	ch := rejectingChain(t, common.Hash256{10})
+	slot := constants.GENESIS_SLOT + constants.EPOCH_LENGTH
+	s := &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{2}, Slot: slot + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	f := &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{3}, Slot: slot,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	fCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH + 1, Root: f.Hash}
+	a := &block.BeaconBlock{ParentHash: f.Hash, Hash: common.Hash256{4}, Slot: slot + 2,
+		JustifiedCheckpoint: fCp, FinalizedCheckpoint: fCp}
+	for _, b := range []*block.BeaconBlock{s, f, a} {
+		blockIn(t, ch, b)
+	}
+	if err := ch.Justify(fCp); err != nil {
+		t.Fatal(err)
+	}
+	if err := ch.Finalize(fCp); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ch.Dag.Nodes[s.Hash]; !ok {
+		t.Fatal("expected the sibling of the finalized block to stay in the dag")
+	}
+
+	cases := []struct {
+		name string
+		block *block.BeaconBlock
+		err error
+	}{
+		{"duplicate", &block.BeaconBlock{ParentHash: f.Hash, Hash: a.Hash, Slot: slot + 3,
+			JustifiedCheckpoint: fCp, FinalizedCheckpoint: fCp}, ErrDuplicateBlock},
+		{"slot not after parent", &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{5}, Slot: a.Slot,
+			JustifiedCheckpoint: fCp, FinalizedCheckpoint: fCp}, ErrSlotNotAfterParent},
+		{"at finalized slot", &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{6}, Slot: f.Slot,
+			JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}, ErrConflictsWithFinality},
+		{"not descending from finalized", &block.BeaconBlock{ParentHash: s.Hash, Hash: common.Hash256{7}, Slot: s.Slot + 1,
+			JustifiedCheckpoint: fCp, FinalizedCheckpoint: fCp}, ErrConflictsWithFinality},
+		{"finalized after justified", &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{8}, Slot: a.Slot + 1,
+			JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: fCp}, ErrInvalidCheckpoints},
+		{"justified after block", &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{9}, Slot: a.Slot + 1,
+			JustifiedCheckpoint: common.Checkpoint{Epoch: constants.GENESIS_EPOCH + 2, Root: a.Hash}, FinalizedCheckpoint: fCp}, ErrInvalidCheckpoints},
+		{"rejected by the fork-choice rule", &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{10}, Slot: a.Slot + 1,
+			JustifiedCheckpoint: fCp, FinalizedCheckpoint: fCp}, errRuleRejects},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			before := snapshot(t, ch, c.block.Hash)
+			res, err := ch.BlockIn(c.block)
+			if err != c.err {
+				t.Fatalf("expected %v, got %v", c.err, err)
+			}
+			if res != dag.BlockRejected {
+				t.Fatalf("expected the block to be %s, got %s", dag.BlockRejected, res)
+			}
+			if !before.equals(snapshot(t, ch, c.block.Hash)) {
+				t.Fatal("the rejected block changed the chain")
+			}
+		})
+	}
+}
+
+func TestDroppedOrphanCanBeResent(t *testing.T) {
+	ch := testChain(t, 4)
+	p := &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{2}, Slot: constants.GENESIS_SLOT + 2,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	// not after its parent, this is only detected when the parent arrives
+	x := &block.BeaconBlock{ParentHash: p.Hash, Hash: common.Hash256{3}, Slot: p.Slot,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	if res, err := ch.BlockIn(x); err != nil || res != dag.BlockQueuedAsOrphan {
+		t.Fatalf("expected the block to be queued as orphan, got %s %v", res, err)
+	}
+	blockIn(t, ch, p)
+	if stored, _ := ch.Storage.GetBlock(x.Hash); stored != nil {
+		t.Fatal("expected the dropped orphan to be removed from storage")
+	}
+	if _, err := ch.BlockIn(x); err != ErrSlotNotAfterParent {
+		t.Fatalf("expected %v for the resent orphan, got %v", ErrSlotNotAfterParent, err)
+	}
+}
+
+// g <- p <- {x <- x2, y}: x is rejected by the fork-choice rule when p arrives. p and y are imported, x and x2 are dropped.
+func TestRejectedOrphan(t *testing.T) {
+	p := &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{2}, Slot: constants.GENESIS_SLOT + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	x := &block.BeaconBlock{ParentHash: p.Hash, Hash: common.Hash256{3}, Slot: p.Slot + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	x2 := &block.BeaconBlock{ParentHash: x.Hash, Hash: common.Hash256{4}, Slot: x.Slot + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	y := &block.BeaconBlock{ParentHash: p.Hash, Hash: common.Hash256{5}, Slot: p.Slot + 2,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	ch := rejectingChain(t, x.Hash)
+	for _, b := range []*block.BeaconBlock{x, x2, y} {
+		if res, err := ch.BlockIn(b); err != nil || res != dag.BlockQueuedAsOrphan {
+			t.Fatalf("expected block %s to be queued as orphan, got %s %v", b.Hash, res, err)
+		}
+	}
+	blockIn(t, ch, p)
+	if _, ok := ch.Dag.Nodes[y.Hash]; !ok {
+		t.Fatal("expected the orphan after the rejected orphan to be imported")
+	}
+	for _, b := range []*block.BeaconBlock{x, x2} {
+		if _, ok := ch.Dag.Nodes[b.Hash]; ok {
+			t.Fatalf("expected block %s not to be imported", b.Hash)
+		}
+		if stored, _ := ch.Storage.GetBlock(b.Hash); stored != nil {
+			t.Fatalf("expected block %s to be removed from storage", b.Hash)
+		}
+	}
+	if n := ch.Dag.OrphanCount(); n != 0 {
+		t.Fatalf("expected no orphans left, got %d", n)
+	}
+	if children := ch.Dag.Nodes[p.Hash].Children; len(children) != 1 || children[0].Key != y.Hash {
+		t.Fatalf("expected only %s as child of %s", y.Hash, p.Hash)
+	}
+	if head := ch.Head(); head != y.Hash {
+		t.Fatalf("expected head %s, got %s", y.Hash, head)
+	}
+}
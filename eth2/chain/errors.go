@@ -0,0 +1,36 @@
+package chain
+
+import "errors"
+
+// Reasons to reject a block, returned as-is, so callers can compare and count them.
+var (
+	// The block was added before (it may still wait for its parent).
+	ErrDuplicateBlock = errors.New("duplicate block")
+
+	// The slot of the block is not after the slot of its parent.
+	ErrSlotNotAfterParent = errors.New("block slot is not after the slot of its parent")
+
+	// The block is at or before the finalized block, or does not descend from it.
+	ErrConflictsWithFinality = errors.New("block conflicts with the finalized checkpoint")
+
+	// The checkpoints of the block are inconsistent: the finalized checkpoint is newer than the justified checkpoint,
+	//  or the justified checkpoint is newer than the block.
+	ErrInvalidCheckpoints = errors.New("block has inconsistent checkpoints")
+)
+
+// Reasons to reject an attestation, returned as-is, so callers can compare and count them.
+var (
+	// The attestation is for a slot after the current slot of the chain (see OnSlot).
+	ErrFutureSlot = errors.New("attestation for a future slot")
+
+	// The attestation, or the block it votes for, is older than the finalized checkpoint.
+	ErrBeforeFinalized = errors.New("attestation older than the finalized checkpoint")
+
+	ErrUnknownValidator = errors.New("attestation by unknown validator")
+
+	ErrInactiveValidator = errors.New("attestation by inactive validator")
+
+	// The same vote (attester, slot and block) is already the latest message of the attester,
+	//  or it waits for its block in the pending pool already.
+	ErrDuplicateAttestation = errors.New("duplicate attestation")
+)
@@ -0,0 +1,303 @@
+package chain
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"lmd-ghost/eth2/data/validator"
+	"lmd-ghost/eth2/fork_choice/choices/proto_array"
+	"sort"
+	"testing"
+)
+
+// Records the score changes applied to the proto_array rule.
+type recordingRule struct {
+	dag.ForkChoice
+	changes []dag.ScoreChange
+}
+
+func (r *recordingRule) ApplyScoreChanges(changes []dag.ScoreChange) error {
+	r.changes = append(r.changes, changes...)
+	return r.ForkChoice.ApplyScoreChanges(changes)
+}
+
+// Takes the score changes recorded since the last call, as total delta per block.
+func (r *recordingRule) take() map[common.Hash256]int64 {
+	res := make(map[common.Hash256]int64)
+	for _, c := range r.changes {
+		res[c.Target.Key] += c.ScoreDelta
+	}
+	r.changes = nil
+	return res
+}
+
+func recordingChain(t *testing.T, validators int) (*BeaconChain, *recordingRule) {
+	var rec *recordingRule
+	ch := testChainWith(t, validators, func(d *dag.BeaconDag) dag.ForkChoice {
+		rec = &recordingRule{ForkChoice: proto_array.NewProtoArrayLMDGhost(d)}
+		return rec
+	})
+	return ch, rec
+}
+
+func attestationIn(t *testing.T, ch *BeaconChain, id common.ValidatorID, b *block.BeaconBlock, slot uint64) {
+	t.Helper()
+	if res, err := ch.AttestationIn(&attestation.Attestation{BeaconBlockRoot: b.Hash, Attester: id, Slot: slot}); err != nil || res != AttestationAccepted {
+		t.Fatalf("attestation of %d for %s not accepted: %s %v", id, b.Hash, res, err)
+	}
+}
+
+func TestBalanceChangeScoreChange(t *testing.T) {
+	ch, rec := recordingChain(t, 4)
+	a := &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{2}, Slot: constants.GENESIS_SLOT + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	blockIn(t, ch, a)
+	if err := ch.OnSlot(a.Slot); err != nil {
+		t.Fatal(err)
+	}
+	attestationIn(t, ch, 1, a, a.Slot)
+	if err := ch.UpdateHead(); err != nil {
+		t.Fatal(err)
+	}
+	if changes := rec.take(); len(changes) != 1 || changes[a.Hash] != int64(constants.MAX_EFFECTIVE_BALANCE) {
+		t.Fatalf("expected the vote to add the effective balance to %s, got %v", a.Hash, changes)
+	}
+
+	increment := constants.EFFECTIVE_BALANCE_INCREMENT
+	cases := []struct {
+		name string
+		id common.ValidatorID
+		balance uint64
+		delta int64
+	}{
+		// the effective balance is rounded down to whole increments
+		{"penalty", 1, 20 * increment + increment / 2, -12 * int64(increment)},
+		{"change within the increment", 1, 20 * increment + increment / 3, 0},
+		// and capped
+		{"reward above the maximum", 1, constants.MAX_EFFECTIVE_BALANCE + 3 * increment, 12 * int64(increment)},
+		{"validator without a vote", 2, 10 * increment, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := ch.SetBalance(c.id, c.balance); err != nil {
+				t.Fatal(err)
+			}
+			if err := ch.UpdateHead(); err != nil {
+				t.Fatal(err)
+			}
+			changes := rec.take()
+			if c.delta == 0 {
+				if len(changes) != 0 {
+					t.Fatalf("expected no score change, got %v", changes)
+				}
+				return
+			}
+			if len(changes) != 1 || changes[a.Hash] != c.delta {
+				t.Fatalf("expected a score change of %d for %s, got %v", c.delta, a.Hash, changes)
+			}
+		})
+	}
+	if w := ch.Dag.GetWeight(ch.Dag.Nodes[a.Hash]); w != int64(constants.MAX_EFFECTIVE_BALANCE) {
+		t.Fatalf("expected %s to weigh the effective balance of its voter, got %d", a.Hash, w)
+	}
+}
+
+// Validators 0 and 1 vote for a, validator 2 for b: when 0 and 1 exit, their weight stops counting, and b becomes the head.
+// A validator that activates later starts counting at its activation epoch.
+func TestExitRemovesWeight(t *testing.T) {
+	ch, rec := recordingChain(t, 4)
+	late := validator.NewValidator(4, constants.MAX_EFFECTIVE_BALANCE, constants.GENESIS_EPOCH + 2)
+	if err := ch.Registry.Add(late); err != nil {
+		t.Fatal(err)
+	}
+	a := &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{3}, Slot: constants.GENESIS_SLOT + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	b := &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{2}, Slot: constants.GENESIS_SLOT + 2,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	blockIn(t, ch, a)
+	blockIn(t, ch, b)
+	if err := ch.OnSlot(b.Slot); err != nil {
+		t.Fatal(err)
+	}
+	attestationIn(t, ch, 0, a, b.Slot)
+	attestationIn(t, ch, 1, a, b.Slot)
+	attestationIn(t, ch, 2, b, b.Slot)
+	if _, err := ch.AttestationIn(&attestation.Attestation{BeaconBlockRoot: b.Hash, Attester: 4, Slot: b.Slot}); err != ErrInactiveValidator {
+		t.Fatalf("expected %v before the activation, got %v", ErrInactiveValidator, err)
+	}
+	if err := ch.UpdateHead(); err != nil {
+		t.Fatal(err)
+	}
+	if head := ch.Head(); head != a.Hash {
+		t.Fatalf("expected head %s, got %s", a.Hash, head)
+	}
+	rec.take()
+
+	for _, id := range []common.ValidatorID{0, 1} {
+		if err := ch.Registry.Exit(id, constants.GENESIS_EPOCH + 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// still active until the exit epoch starts
+	if err := ch.OnSlot(constants.GENESIS_SLOT + constants.EPOCH_LENGTH - 1); err != nil {
+		t.Fatal(err)
+	}
+	if head := ch.Head(); head != a.Hash {
+		t.Fatalf("expected head %s before the exit epoch, got %s", a.Hash, head)
+	}
+	if err := ch.OnSlot(constants.GENESIS_SLOT + constants.EPOCH_LENGTH); err != nil {
+		t.Fatal(err)
+	}
+	if head := ch.Head(); head != b.Hash {
+		t.Fatalf("expected head %s after the exits, got %s", b.Hash, head)
+	}
+	if changes := rec.take(); changes[a.Hash] != -2 * int64(constants.MAX_EFFECTIVE_BALANCE) || changes[b.Hash] != 0 {
+		t.Fatalf("expected the exits to remove their weight from %s, got %v", a.Hash, changes)
+	}
+	if w := ch.Dag.GetWeight(ch.Dag.Nodes[a.Hash]); w != 0 {
+		t.Fatalf("expected %s to weigh nothing after the exits, got %d", a.Hash, w)
+	}
+	if total := ch.Registry.TotalActiveBalance(); total != 2 * constants.MAX_EFFECTIVE_BALANCE {
+		t.Fatalf("expected the total active balance of 2 validators, got %d", total)
+	}
+	slot := constants.GENESIS_SLOT + constants.EPOCH_LENGTH
+	if _, err := ch.AttestationIn(&attestation.Attestation{BeaconBlockRoot: a.Hash, Attester: 0, Slot: slot}); err != ErrInactiveValidator {
+		t.Fatalf("expected %v after the exit, got %v", ErrInactiveValidator, err)
+	}
+
+	// the late validator counts from its activation epoch
+	slot = constants.GENESIS_SLOT + 2 * constants.EPOCH_LENGTH
+	if err := ch.OnSlot(slot); err != nil {
+		t.Fatal(err)
+	}
+	attestationIn(t, ch, 4, a, slot)
+	if err := ch.UpdateHead(); err != nil {
+		t.Fatal(err)
+	}
+	if changes := rec.take(); len(changes) != 1 || changes[a.Hash] != int64(constants.MAX_EFFECTIVE_BALANCE) {
+		t.Fatalf("expected the vote of the activated validator to add its weight to %s, got %v", a.Hash, changes)
+	}
+}
+
+// g <- a <- a2, and g <- b. Voters are the direct votes only, WeightFrom includes the votes for descendants.
+func TestVotersAndWeightFrom(t *testing.T) {
+	ch := testChain(t, 4 * int(constants.EPOCH_LENGTH))
+	a := &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{2}, Slot: constants.GENESIS_SLOT + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	a2 := &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{3}, Slot: constants.GENESIS_SLOT + 2,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	b := &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: common.Hash256{4}, Slot: constants.GENESIS_SLOT + 3,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	for _, bl := range []*block.BeaconBlock{a, a2, b} {
+		blockIn(t, ch, bl)
+	}
+	slot := b.Slot
+	if err := ch.OnSlot(slot); err != nil {
+		t.Fatal(err)
+	}
+	// the committee of the slot votes for a2 as an aggregate, the others one at a time
+	committee, err := ch.Registry.Committee(slot, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agg := attestation.NewAggregateAttestation(a2.Hash, slot, 0, len(committee))
+	var aggVoters []common.ValidatorID
+	for j, v := range committee {
+		agg.SetParticipant(j)
+		aggVoters = append(aggVoters, v.Id)
+	}
+	if len(aggVoters) < 2 {
+		t.Fatalf("expected a committee of more than 1 validator, got %d", len(aggVoters))
+	}
+	if res, err := ch.AggregateAttestationIn(agg); err != nil || res != AttestationAccepted {
+		t.Fatalf("aggregate not accepted: %s %v", res, err)
+	}
+	isAggVoter := make(map[common.ValidatorID]bool)
+	for _, id := range aggVoters {
+		isAggVoter[id] = true
+	}
+	var others []common.ValidatorID
+	for id := common.ValidatorID(0); len(others) < 3; id++ {
+		if !isAggVoter[id] {
+			others = append(others, id)
+		}
+	}
+	attestationIn(t, ch, others[2], a, slot)
+	attestationIn(t, ch, others[0], a, slot)
+	attestationIn(t, ch, others[1], b, slot)
+
+	sorted := append([]common.ValidatorID(nil), aggVoters...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	expectVoters := func(bl *block.BeaconBlock, expected []common.ValidatorID) {
+		t.Helper()
+		voters, err := ch.Voters(bl.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(voters) != len(expected) {
+			t.Fatalf("expected voters %v for %s, got %v", expected, bl.Hash, voters)
+		}
+		for i := range voters {
+			if voters[i] != expected[i] {
+				t.Fatalf("expected voters %v for %s, got %v", expected, bl.Hash, voters)
+			}
+		}
+	}
+	expectVoters(a2, sorted)
+	expectVoters(a, []common.ValidatorID{others[0], others[2]})
+	expectVoters(b, []common.ValidatorID{others[1]})
+	expectVoters(&block.BeaconBlock{Hash: genesisCp.Root}, nil)
+	if _, err := ch.Voters(common.Hash256{9}); err == nil {
+		t.Fatal("expected an error for the voters of an unknown block")
+	}
+
+	balance := int64(constants.MAX_EFFECTIVE_BALANCE)
+	everyone := append(append([]common.ValidatorID(nil), aggVoters...), others...)
+	cases := []struct {
+		name string
+		block common.Hash256
+		validators []common.ValidatorID
+		weight int64
+	}{
+		{"aggregate for its target", a2.Hash, aggVoters, int64(len(aggVoters)) * balance},
+		{"aggregate for an ancestor", a.Hash, aggVoters, int64(len(aggVoters)) * balance},
+		{"aggregate for the root", genesisCp.Root, aggVoters, int64(len(aggVoters)) * balance},
+		{"aggregate for another branch", b.Hash, aggVoters, 0},
+		{"direct votes", a.Hash, others, 2 * balance},
+		{"votes for the parent do not count for the child", a2.Hash, others, 0},
+		{"everyone", genesisCp.Root, everyone, int64(len(everyone)) * balance},
+		{"no validators", genesisCp.Root, nil, 0},
+	}
+	for _, c := range cases {
+		w, err := ch.WeightFrom(c.block, c.validators)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w != c.weight {
+			t.Errorf("%s: expected weight %d, got %d", c.name, c.weight, w)
+		}
+	}
+	if _, err := ch.WeightFrom(common.Hash256{9}, others); err == nil {
+		t.Fatal("expected an error for the weight of an unknown block")
+	}
+
+	// a new vote moves the voter
+	moved := sorted[0]
+	if err := ch.OnSlot(slot + 1); err != nil {
+		t.Fatal(err)
+	}
+	attestationIn(t, ch, moved, b, slot + 1)
+	expectVoters(a2, sorted[1:])
+	if moved < others[1] {
+		expectVoters(b, []common.ValidatorID{moved, others[1]})
+	} else {
+		expectVoters(b, []common.ValidatorID{others[1], moved})
+	}
+	if w, _ := ch.WeightFrom(a.Hash, []common.ValidatorID{moved}); w != 0 {
+		t.Fatalf("expected the moved vote not to count for %s anymore, got %d", a.Hash, w)
+	}
+}
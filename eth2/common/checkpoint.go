@@ -0,0 +1,16 @@
+package common
+
+import "fmt"
+
+// A checkpoint: the block at the start of an epoch.
+// If the start slot of the epoch is empty, the root is the latest block before it.
+type Checkpoint struct {
+
+	Epoch uint64
+
+	Root Hash256
+}
+
+func (c Checkpoint) String() string {
+	return fmt.Sprintf("%d:%s", c.Epoch, c.Root)
+}
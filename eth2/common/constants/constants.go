@@ -4,3 +4,30 @@ const EPOCH_LENGTH uint64 = 64
 
 const GENESIS_SLOT uint64 = 1 << 20
 
+const GENESIS_EPOCH = GENESIS_SLOT / EPOCH_LENGTH
+
+// Percentage of the committee weight that is added to a timely block, as proposer boost.
+const PROPOSER_SCORE_BOOST uint64 = 40
+
+// Default limit of attestations that wait for their block to arrive.
+const PENDING_ATTESTATIONS_LIMIT uint64 = 1 << 16
+
+// Default limit of blocks that wait for their parent to arrive.
+const ORPHAN_BLOCKS_LIMIT int = 1 << 10
+
+// Default amount of slots an attestation can wait for its block to arrive.
+const PENDING_ATTESTATIONS_EXPIRY uint64 = EPOCH_LENGTH
+
+// Balances are in Gwei. Only whole increments count as effective balance, up to the maximum, like the spec.
+const EFFECTIVE_BALANCE_INCREMENT uint64 = 1000000000
+
+const MAX_EFFECTIVE_BALANCE uint64 = 32 * EFFECTIVE_BALANCE_INCREMENT
+
+// Exit epoch of validators that did not exit, like the spec.
+const FAR_FUTURE_EPOCH uint64 = ^uint64(0)
+
+// Committees, like the spec: every slot has committees of at least the target size (if there are enough validators),
+//  with up to the maximum amount of committees per slot.
+const TARGET_COMMITTEE_SIZE uint64 = 128
+
+const MAX_COMMITTEES_PER_SLOT uint64 = 64
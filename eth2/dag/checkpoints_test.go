@@ -0,0 +1,105 @@
+package dag_test
+
+import (
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"lmd-ghost/eth2/fork_choice/choices/spec"
+	"testing"
+)
+
+type checkpointStep struct {
+	finalize bool
+	cp common.Checkpoint
+}
+
+func (s checkpointStep) apply(d *dag.BeaconDag) error {
+	if s.finalize {
+		return d.Finalize(s.cp)
+	}
+	return d.Justify(s.cp)
+}
+
+func TestCheckpoints(t *testing.T) {
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+	// g <- b1 <- b2 <- b3 <- b4, and the fork g <- f. The first slot of epoch 1 is empty, b3 is at the first slot of epoch 2.
+	start := constants.GENESIS_SLOT
+	g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: start, JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	b1 := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{2}, Slot: start + 10}
+	b2 := &block.BeaconBlock{ParentHash: b1.Hash, Hash: common.Hash256{3}, Slot: start + constants.EPOCH_LENGTH + 6}
+	b3 := &block.BeaconBlock{ParentHash: b2.Hash, Hash: common.Hash256{4}, Slot: start + 2 * constants.EPOCH_LENGTH}
+	b4 := &block.BeaconBlock{ParentHash: b3.Hash, Hash: common.Hash256{5}, Slot: start + 2 * constants.EPOCH_LENGTH + 12}
+	f := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{6}, Slot: start + 50}
+
+	epoch1 := constants.GENESIS_EPOCH + 1
+	epoch2 := constants.GENESIS_EPOCH + 2
+	justify := func(epoch uint64, root common.Hash256) checkpointStep {
+		return checkpointStep{cp: common.Checkpoint{Epoch: epoch, Root: root}}
+	}
+	finalize := func(epoch uint64, root common.Hash256) checkpointStep {
+		return checkpointStep{finalize: true, cp: common.Checkpoint{Epoch: epoch, Root: root}}
+	}
+	cases := []struct {
+		name string
+		setup []checkpointStep
+		step checkpointStep
+		ok bool
+	}{
+		{"justify unknown root", nil, justify(epoch1, common.Hash256{9}), false},
+		{"justify root after the epoch start", nil, justify(epoch1, b2.Hash), false},
+		{"justify root before an empty epoch start", nil, justify(epoch1, b1.Hash), true},
+		{"justify root at the epoch start", nil, justify(epoch2, b3.Hash), true},
+		{"justify older than finalized", []checkpointStep{justify(epoch1, b1.Hash), finalize(epoch1, b1.Hash)},
+			justify(constants.GENESIS_EPOCH, g.Hash), false},
+		{"justify not descending from finalized", []checkpointStep{justify(epoch1, b1.Hash), finalize(epoch1, b1.Hash)},
+			justify(epoch1, f.Hash), false},
+		{"finalize unknown root", []checkpointStep{justify(epoch2, b3.Hash)}, finalize(epoch1, common.Hash256{9}), false},
+		{"finalize root after the epoch start", []checkpointStep{justify(epoch2, b3.Hash)}, finalize(epoch1, b2.Hash), false},
+		{"finalize not justified", nil, finalize(epoch1, b1.Hash), false},
+		{"finalize newer than justified", []checkpointStep{justify(epoch1, b1.Hash)}, finalize(epoch2, b3.Hash), false},
+		{"finalize not an ancestor of justified", []checkpointStep{justify(epoch2, b3.Hash)}, finalize(epoch1, f.Hash), false},
+		{"finalize older than finalized", []checkpointStep{justify(epoch2, b3.Hash), finalize(epoch2, b3.Hash)},
+			finalize(epoch1, b1.Hash), false},
+		{"finalize root before an empty epoch start", []checkpointStep{justify(epoch2, b3.Hash)}, finalize(epoch1, b1.Hash), true},
+		{"finalize root at the epoch start", []checkpointStep{justify(epoch2, b3.Hash)}, finalize(epoch2, b3.Hash), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := dag.NewBeaconDag(spec.NewSpecLMDGhost)
+			for _, b := range []*block.BeaconBlock{g, b1, b2, b3, b4, f} {
+				blockIn(t, d, b)
+			}
+			for _, s := range c.setup {
+				if err := s.apply(d); err != nil {
+					t.Fatal(err)
+				}
+			}
+			justifiedCp, finalizedCp := d.JustifiedCheckpoint, d.FinalizedCheckpoint
+			justified, finalized, nodes := d.Justified, d.Finalized, len(d.Nodes)
+
+			err := c.step.apply(d)
+			if !c.ok {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if d.JustifiedCheckpoint != justifiedCp || d.FinalizedCheckpoint != finalizedCp ||
+					d.Justified != justified || d.Finalized != finalized || len(d.Nodes) != nodes {
+					t.Fatal("expected the rejected checkpoint to change nothing")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			node := d.Nodes[c.step.cp.Root]
+			if c.step.finalize {
+				if d.FinalizedCheckpoint != c.step.cp || d.Finalized != node {
+					t.Fatalf("expected finalized checkpoint %s, got %s", c.step.cp, d.FinalizedCheckpoint)
+				}
+			} else if d.JustifiedCheckpoint != c.step.cp || d.Justified != node {
+				t.Fatalf("expected justified checkpoint %s, got %s", c.step.cp, d.JustifiedCheckpoint)
+			}
+		})
+	}
+}
@@ -1,10 +1,13 @@
 package dag
 
 import (
+	"fmt"
 	"lmd-ghost/eth2/attestations"
 	"lmd-ghost/eth2/attestations/attestation"
 	"lmd-ghost/eth2/block"
 	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"runtime"
 )
 
 /// Beacon-Dag: a collection of the blocks in the canonical chain, and all its unfinalized branches.
@@ -24,25 +27,169 @@ type BeaconDag struct {
 	// This is the node used to start a fork-choice from.
 	// Can be modified freely to anything between finalized and head.
 	Justified *DagNode
+
+	// The store checkpoints, the roots are the finalized and justified nodes.
+	// Leaves of the DAG are only viable for the head if they agree with these.
+	JustifiedCheckpoint common.Checkpoint
+	FinalizedCheckpoint common.Checkpoint
+
+	// filter_block_tree results, from the justified node: node -> leads to a viable leaf.
+	// Reset when the DAG or checkpoints change, computed on demand.
+	viable map[*DagNode]bool
+
+	// Proposer boost: a timely block gets temporary extra weight, until the next slot.
+	// The key of the boosted block, and the extra weight. Zero weight if there is no boost.
+	ProposerBoostRoot common.Hash256
+	ProposerBoostWeight int64
+
+	// The boost as it is currently applied to the fork-choice (updated when changes are synced).
+	appliedBoostRoot common.Hash256
+	appliedBoostWeight int64
+
+	// Blocks whose parent is not known (yet): parent hash -> orphans, imported when the parent arrives.
+	orphans map[common.Hash256][]*block.BeaconBlock
+	orphanCount int
+
+	// Maximum amount of orphans, new orphans are dropped when the pool is full.
+	OrphanLimit int
+	// Orphans dropped because the pool was full, for monitoring.
+	OrphansDropped uint64
+
+	// Called for every orphan that is dropped, e.g. to remove it from storage. Optional.
+	OrphanDropped func(bl *block.BeaconBlock)
+}
+
+/// The result of adding a block to the DAG.
+type ImportResult uint8
+
+const (
+	// The block is part of the DAG now
+	BlockImported ImportResult = iota
+	// The parent of the block is not known (yet), the block is imported when the parent arrives.
+	BlockQueuedAsOrphan
+	// The parent of the block is not known, and the block is not after the finalized block,
+	//  or the orphan pool is full: it is dropped.
+	BlockDroppedAsOrphan
+	// The block was not imported, see the error that is returned with it.
+	BlockRejected
+)
+
+func (r ImportResult) String() string {
+	switch r {
+	case BlockImported:
+		return "imported"
+	case BlockQueuedAsOrphan:
+		return "queued as orphan"
+	case BlockDroppedAsOrphan:
+		return "dropped as orphan"
+	case BlockRejected:
+		return "rejected"
+	default:
+		return "unknown import result"
+	}
 }
 
 func NewBeaconDag(initForkChoice InitForkChoice) *BeaconDag {
 	res := &BeaconDag{
 		synced: false,
 		Nodes: make(map[common.Hash256]*DagNode),
+		orphans: make(map[common.Hash256][]*block.BeaconBlock),
+		OrphanLimit: constants.ORPHAN_BLOCKS_LIMIT,
 	}
 	res.ForkChoice = initForkChoice(res)
+	// a shard per core, the aggregator processes batches of attestations in parallel.
 	res.agor = attestations.NewAttestationsAggregator(func(blockHash common.Hash256) (uint64, bool) {
 		n, ok := res.Nodes[blockHash]
 		if !ok {
 			return 0, false
 		}
 		return n.Slot, ok
-	})
+	}, runtime.GOMAXPROCS(0))
 	return res
 }
 
-func (dag *BeaconDag) BlockIn(block *block.BeaconBlock) {
+/// Adds the block to the DAG. The first block is the root of the DAG, any other block needs a known parent:
+///  if the parent is not known, the block is queued as orphan, and imported when the parent arrives.
+/// Orphans are dropped when there are OrphanLimit orphans already.
+/// Orphans waiting for this block are imported with it, recursively. Orphans that turn out not to be after their parent,
+///  that conflict with the finalized block, or that the fork-choice rule fails to add, are dropped then,
+///  with the orphans waiting for them (see OrphanDropped).
+/// BlockRejected and an error are returned if the fork-choice rule failed to add the block itself, the DAG is unchanged then.
+func (dag *BeaconDag) BlockIn(bl *block.BeaconBlock) (ImportResult, error) {
+	if dag.Finalized != nil {
+		if _, ok := dag.Nodes[bl.ParentHash]; !ok {
+			if bl.Slot <= dag.Finalized.Slot {
+				// the parent may have been pruned already, it will never be imported.
+				dag.dropOrphan(bl)
+				return BlockDroppedAsOrphan, nil
+			}
+			if dag.orphanCount >= dag.OrphanLimit {
+				dag.OrphansDropped++
+				dag.dropOrphan(bl)
+				return BlockDroppedAsOrphan, nil
+			}
+			dag.orphans[bl.ParentHash] = append(dag.orphans[bl.ParentHash], bl)
+			dag.orphanCount++
+			return BlockQueuedAsOrphan, nil
+		}
+	}
+	// import the block, and then the orphans that were waiting for it, parents before children.
+	queue := []*block.BeaconBlock{bl}
+	for i := 0; i < len(queue); i++ {
+		// orphans could not be checked against their parent when they arrived:
+		//  drop those that cannot be imported, and the orphans waiting for them.
+		if i > 0 && !dag.orphanFits(queue[i]) {
+			dag.dropOrphanTree(queue[i])
+			continue
+		}
+		if err := dag.importBlock(queue[i]); err != nil {
+			if i == 0 {
+				return BlockRejected, err
+			}
+			// the block itself is imported, the orphan is rejected like one that does not fit.
+			dag.dropOrphanTree(queue[i])
+			continue
+		}
+		if orphans, ok := dag.orphans[queue[i].Hash]; ok {
+			delete(dag.orphans, queue[i].Hash)
+			dag.orphanCount -= len(orphans)
+			queue = append(queue, orphans...)
+		}
+	}
+	return BlockImported, nil
+}
+
+func (dag *BeaconDag) dropOrphan(bl *block.BeaconBlock) {
+	if dag.OrphanDropped != nil {
+		dag.OrphanDropped(bl)
+	}
+}
+
+// Drops the orphan, and the orphans waiting for it, recursively: they will never be imported.
+func (dag *BeaconDag) dropOrphanTree(bl *block.BeaconBlock) {
+	dag.dropOrphan(bl)
+	if orphans, ok := dag.orphans[bl.Hash]; ok {
+		delete(dag.orphans, bl.Hash)
+		dag.orphanCount -= len(orphans)
+		for _, o := range orphans {
+			dag.dropOrphanTree(o)
+		}
+	}
+}
+
+// Checks an orphan against its parent (now in the DAG), and the finalized block:
+//  it must be after its parent, and descend from the finalized block, after it.
+func (dag *BeaconDag) orphanFits(bl *block.BeaconBlock) bool {
+	parent := dag.Nodes[bl.ParentHash]
+	return bl.Slot > parent.Slot && bl.Slot > dag.Finalized.Slot && IsAncestor(dag.Finalized, parent)
+}
+
+/// The amount of blocks that wait for their parent to arrive.
+func (dag *BeaconDag) OrphanCount() int {
+	return dag.orphanCount
+}
+
+func (dag *BeaconDag) importBlock(block *block.BeaconBlock) error {
 	dag.synced = false
 	// Create a node in the DAG for the block
 	node := &DagNode{
@@ -52,23 +199,57 @@ func (dag *BeaconDag) BlockIn(block *block.BeaconBlock) {
 		Children: make([]*DagNode, 0, 8),
 		Key: block.Hash,
 		Slot: block.Slot,
+		JustifiedCheckpoint: block.JustifiedCheckpoint,
+		FinalizedCheckpoint: block.FinalizedCheckpoint,
 		Height: 0,
 		Weight: 0,
 	}
 	// append to parent's children if there is a parent
 	if node.Parent != nil {
+		// descendants of invalid blocks are invalid
+		node.Invalid = node.Parent.Invalid
 		node.IndexAsChild = uint32(len(node.Parent.Children))
 		node.Parent.Children = append(node.Parent.Children, node)
 		node.Height = node.Parent.Height + 1
 	}
 	dag.Nodes[block.Hash] = node
+	dag.viable = nil
+	// the first node is the initial checkpoint
 	if dag.Finalized == nil {
 		dag.Finalized = node
+		dag.FinalizedCheckpoint = common.Checkpoint{Epoch: node.Slot / constants.EPOCH_LENGTH, Root: node.Key}
 	}
 	if dag.Justified == nil {
 		dag.Justified = node
+		dag.JustifiedCheckpoint = common.Checkpoint{Epoch: node.Slot / constants.EPOCH_LENGTH, Root: node.Key}
+	}
+	if err := dag.ForkChoice.OnNewNode(node); err != nil {
+		dag.removeNode(node)
+		return err
+	}
+	// attestations may have arrived before the block
+	dag.agor.OnBlockIn(block.Hash)
+	return nil
+}
+
+// Undoes importBlock, for a block that the fork-choice rule did not accept: the DAG is left as if the block never arrived.
+// The rule is expected to leave its own state unchanged when it returns an error.
+func (dag *BeaconDag) removeNode(node *DagNode) {
+	if node.Parent != nil {
+		// the node was appended last
+		node.Parent.Children[node.IndexAsChild] = nil
+		node.Parent.Children = node.Parent.Children[:node.IndexAsChild]
+	}
+	delete(dag.Nodes, node.Key)
+	dag.viable = nil
+	if dag.Finalized == node {
+		dag.Finalized = nil
+		dag.FinalizedCheckpoint = common.Checkpoint{}
+	}
+	if dag.Justified == node {
+		dag.Justified = nil
+		dag.JustifiedCheckpoint = common.Checkpoint{}
 	}
-	dag.ForkChoice.OnNewNode(node)
 }
 
 func (dag *BeaconDag) AttestationIn(atIn *attestation.Attestation) {
@@ -77,13 +258,114 @@ func (dag *BeaconDag) AttestationIn(atIn *attestation.Attestation) {
 	dag.agor.AttestationIn(atIn)
 }
 
-func (dag *BeaconDag) Justify(blockHash common.Hash256) {
-	dag.Justified = dag.Nodes[blockHash]
+/// Adds the attestations in one batch, the aggregator processes large batches in parallel.
+/// Equivalent to AttestationIn for every attestation, in order.
+func (dag *BeaconDag) AttestationsIn(ats []*attestation.Attestation) {
+	dag.synced = false
+	dag.agor.AttestationsIn(ats)
+}
+
+/// Adds the votes of the attesters of a committee aggregate, for the same block and slot, in one batch.
+func (dag *BeaconDag) AggregateIn(blockRoot common.Hash256, slot uint64, attesters []common.ValidatorID, weights []uint64) {
+	dag.synced = false
+	dag.agor.AggregateIn(blockRoot, slot, attesters, weights)
+}
+
+/// Starts the given slot. Pending attestations that waited too long for their block are dropped.
+/// If the fork-choice rule expires votes, the expired votes are removed,
+///  and their weight is taken away from the fork-choice when changes are synced.
+func (dag *BeaconDag) OnSlot(slot uint64) {
+	dag.agor.Pending.Expire(slot)
+	if expiry, ok := dag.ForkChoice.(VoteExpiry); ok {
+		dag.synced = false
+		dag.agor.ExpireAttestations(expiry.MinVoteSlot(slot))
+	}
+}
+
+/// Attestations that wait for their block to arrive. Exposed for monitoring and configuration (limit, expiry).
+func (dag *BeaconDag) PendingAttestations() *attestations.PendingPool {
+	return dag.agor.Pending
+}
+
+/// Derive the weight of attestations from the attester (e.g. its effective balance), when they are processed.
+func (dag *BeaconDag) SetWeightLookup(weightLookup attestations.WeightLookupFn) {
+	dag.agor.WeightLookup = weightLookup
+}
+
+/// Changes the weight of the latest message of the validator, if it has one.
+/// The difference is applied to the fork-choice like any other score change.
+func (dag *BeaconDag) UpdateValidatorWeight(id common.ValidatorID, weight uint64) {
+	dag.synced = false
+	dag.agor.UpdateWeight(id, weight)
+}
+
+/// Removes the latest message of the validator, e.g. when it exited.
+/// The removed weight is applied to the fork-choice like any other score change.
+func (dag *BeaconDag) RemoveValidatorVote(id common.ValidatorID) {
+	dag.synced = false
+	dag.agor.RemoveLatest(id)
+}
+
+/// Validators that attested to different blocks in the same slot, sorted by ID.
+/// Their weight does not count anymore.
+func (dag *BeaconDag) EquivocatingValidators() []common.ValidatorID {
+	return dag.agor.EquivocatingValidators()
+}
+
+// Looks up the node of the checkpoint root, and checks if it is a valid root for the checkpoint epoch.
+func (dag *BeaconDag) checkpointNode(cp common.Checkpoint) (*DagNode, error) {
+	node, ok := dag.Nodes[cp.Root]
+	if !ok {
+		return nil, fmt.Errorf("checkpoint %s has unknown root", cp)
+	}
+	// The root may be from an earlier epoch, if the start of the epoch is empty, but not from a later slot.
+	if epochStart := cp.Epoch * constants.EPOCH_LENGTH; node.Slot > epochStart {
+		return nil, fmt.Errorf("checkpoint %s has root at slot %d, after the start of the epoch, slot %d",
+			cp, node.Slot, epochStart)
+	}
+	return node, nil
+}
+
+/// Changes the justified checkpoint, the starting point of the fork-choice.
+/// The root must be known, and the finalized node must be an ancestor of it.
+func (dag *BeaconDag) Justify(cp common.Checkpoint) error {
+	node, err := dag.checkpointNode(cp)
+	if err != nil {
+		return err
+	}
+	if cp.Epoch < dag.FinalizedCheckpoint.Epoch {
+		return fmt.Errorf("justified checkpoint %s is older than finalized checkpoint %s", cp, dag.FinalizedCheckpoint)
+	}
+	if !IsAncestor(dag.Finalized, node) {
+		return fmt.Errorf("justified checkpoint %s does not descend from finalized checkpoint %s", cp, dag.FinalizedCheckpoint)
+	}
+	dag.synced = false
+	dag.Justified = node
+	dag.JustifiedCheckpoint = cp
+	dag.viable = nil
+	return dag.ForkChoice.OnCheckpointsChange()
 }
 
-func (dag *BeaconDag) Finalize(blockHash common.Hash256) {
+/// Changes the finalized checkpoint, and prunes everything older than it.
+/// The root must be known, and it must be an ancestor of the justified node.
+func (dag *BeaconDag) Finalize(cp common.Checkpoint) error {
+	node, err := dag.checkpointNode(cp)
+	if err != nil {
+		return err
+	}
+	if cp.Epoch < dag.FinalizedCheckpoint.Epoch {
+		return fmt.Errorf("finalized checkpoint %s is older than the current finalized checkpoint %s", cp, dag.FinalizedCheckpoint)
+	}
+	if cp.Epoch > dag.JustifiedCheckpoint.Epoch {
+		return fmt.Errorf("finalized checkpoint %s is newer than justified checkpoint %s", cp, dag.JustifiedCheckpoint)
+	}
+	if !IsAncestor(node, dag.Justified) {
+		return fmt.Errorf("finalized checkpoint %s is not an ancestor of justified checkpoint %s", cp, dag.JustifiedCheckpoint)
+	}
 	dag.synced = false
-	dag.Finalized = dag.Nodes[blockHash]
+	dag.Finalized = node
+	dag.FinalizedCheckpoint = cp
+	dag.viable = nil
 	// Prune away everything older than the finalized block
 	for k, v := range dag.Nodes {
 		if v.Slot < dag.Finalized.Slot {
@@ -94,35 +376,231 @@ func (dag *BeaconDag) Finalize(blockHash common.Hash256) {
 			}
 		}
 	}
+	// Votes for slots before the finalized block are rejected, conflicts with them do not have to be detected.
+	dag.agor.PruneVotes(dag.Finalized.Slot)
+	// Drop the orphans that are not after the finalized block, and the orphans waiting for them:
+	//  they conflict with finality, their parents will never be imported.
+	var dropped []*block.BeaconBlock
+	for parent, orphans := range dag.orphans {
+		remaining := orphans[:0]
+		for _, o := range orphans {
+			if o.Slot > dag.Finalized.Slot {
+				remaining = append(remaining, o)
+			} else {
+				dropped = append(dropped, o)
+			}
+		}
+		dag.orphanCount -= len(orphans) - len(remaining)
+		if len(remaining) == 0 {
+			delete(dag.orphans, parent)
+		} else {
+			dag.orphans[parent] = remaining
+		}
+	}
+	for _, o := range dropped {
+		dag.dropOrphanTree(o)
+	}
 	//log.Println("pruned data! new size: ", len(dag.Nodes))
 	// make the fork-choice rule aware of the pruning
-	dag.ForkChoice.OnPrune()
+	if err := dag.ForkChoice.OnPrune(); err != nil {
+		return err
+	}
+	return dag.ForkChoice.OnCheckpointsChange()
 }
 
-func (dag *BeaconDag) SyncChanges() {
+/// Marks the block and all its descendants as invalid, e.g. when a later state-transition check failed.
+/// Their weight is removed, and they are excluded from the head.
+/// The justified block and its ancestors cannot be invalidated.
+func (dag *BeaconDag) InvalidateBlock(blockHash common.Hash256) error {
+	node, ok := dag.Nodes[blockHash]
+	if !ok {
+		return fmt.Errorf("cannot invalidate unknown block %s", blockHash)
+	}
+	if node.Invalid {
+		// already invalid, together with its descendants
+		return nil
+	}
+	if IsAncestor(node, dag.Justified) {
+		return fmt.Errorf("cannot invalidate block %s, it is the justified block %s, or one of its ancestors",
+			blockHash, dag.Justified.Key)
+	}
+	// Apply any pending changes first: the weight that is known to the fork-choice is removed.
+	if !dag.synced {
+		if err := dag.SyncChanges(); err != nil {
+			return err
+		}
+	}
+	// the subtree, parents before children.
+	// Parts that were invalidated before are skipped, their weight has been removed already.
+	subtree := []*DagNode{node}
+	for i := 0; i < len(subtree); i++ {
+		for _, c := range subtree[i].Children {
+			if !c.Invalid {
+				subtree = append(subtree, c)
+			}
+		}
+	}
+	changes := make([]ScoreChange, 0)
+	for _, n := range subtree {
+		if applied := dag.agor.AppliedWeight(n.Key); applied != 0 {
+			changes = append(changes, ScoreChange{Target: n, ScoreDelta: -int64(applied)})
+		}
+		if n.Key == dag.appliedBoostRoot && dag.appliedBoostWeight != 0 {
+			changes = append(changes, ScoreChange{Target: n, ScoreDelta: -dag.appliedBoostWeight})
+		}
+	}
+	if err := dag.ForkChoice.ApplyScoreChanges(changes); err != nil {
+		return err
+	}
+	// From now on, changes for invalid targets are ignored, see SyncChanges.
+	for _, n := range subtree {
+		n.Invalid = true
+	}
+	dag.viable = nil
+	dag.synced = false
+	return dag.ForkChoice.OnInvalidate(node)
+}
+
+/// Boosts the block with a fraction (PROPOSER_SCORE_BOOST percent) of the committee weight, replacing any previous boost.
+func (dag *BeaconDag) ApplyProposerBoost(blockHash common.Hash256, committeeWeight uint64) {
+	dag.synced = false
+	dag.ProposerBoostRoot = blockHash
+	dag.ProposerBoostWeight = int64(committeeWeight * constants.PROPOSER_SCORE_BOOST / 100)
+}
+
+/// Removes the proposer boost, e.g. when the next slot starts.
+func (dag *BeaconDag) ExpireProposerBoost() {
+	dag.synced = false
+	dag.ProposerBoostRoot = common.Hash256{}
+	dag.ProposerBoostWeight = 0
+}
+
+/// Applies the weight changes (attestations, proposer boost) to the fork-choice rule.
+func (dag *BeaconDag) SyncChanges() error {
 	// Find all the changes made in the aggregator and apply them to the DAG.
 	changes := make([]ScoreChange, 0)
-	for k, v := range dag.agor.LatestAggregates {
-		if v.PrevWeight != v.Weight {
-			// get delta
-			delta := int64(v.Weight) - int64(v.PrevWeight)
-			// resolve difference in weight
-			v.PrevWeight = v.Weight
-			// remember the change, append it to our "to do" list of changes
-			changes = append(changes, ScoreChange{Target: dag.Nodes[k], ScoreDelta: delta})
+	// The proposer boost is just like any other weight, a change is a score change, to the boosted block.
+	if dag.appliedBoostRoot != dag.ProposerBoostRoot || dag.appliedBoostWeight != dag.ProposerBoostWeight {
+		// (the weight of invalid targets was removed when they were invalidated)
+		if target, ok := dag.Nodes[dag.appliedBoostRoot]; ok && !target.Invalid && dag.appliedBoostWeight != 0 {
+			changes = append(changes, ScoreChange{Target: target, ScoreDelta: -dag.appliedBoostWeight})
+		}
+		if target, ok := dag.Nodes[dag.ProposerBoostRoot]; ok && !target.Invalid && dag.ProposerBoostWeight != 0 {
+			changes = append(changes, ScoreChange{Target: target, ScoreDelta: dag.ProposerBoostWeight})
 		}
+		dag.appliedBoostRoot = dag.ProposerBoostRoot
+		dag.appliedBoostWeight = dag.ProposerBoostWeight
+	}
+	for _, d := range mergeDeltas(dag.agor.TakeDeltas()) {
+		// remember the change, append it to our "to do" list of changes
+		// (changes of shards may cancel out, targets that were pruned away in the meantime are not part of the DAG anymore,
+		//  and the votes for invalid targets do not count)
+		if target, ok := dag.Nodes[d.Target]; ok && !target.Invalid && d.Delta != 0 {
+			changes = append(changes, ScoreChange{Target: target, ScoreDelta: d.Delta})
+		}
+	}
+	if err := dag.ForkChoice.ApplyScoreChanges(changes); err != nil {
+		return err
 	}
-	dag.ForkChoice.ApplyScoreChanges(changes)
 	dag.synced = true
+	return nil
 }
 
-func (dag *BeaconDag) HeadFn() common.Hash256 {
+// Every shard of the aggregator has its own changes, the changes of the shards for the same target are merged into one.
+func mergeDeltas(shardDeltas [][]attestations.WeightDelta) []attestations.WeightDelta {
+	var res []attestations.WeightDelta
+	for _, deltas := range shardDeltas {
+		if len(deltas) == 0 {
+			continue
+		}
+		if res != nil {
+			// changes in more than one shard
+			merged := make(map[common.Hash256]int64)
+			for _, deltas := range shardDeltas {
+				for _, d := range deltas {
+					merged[d.Target] += d.Delta
+				}
+			}
+			res = make([]attestations.WeightDelta, 0, len(merged))
+			for k, delta := range merged {
+				res = append(res, attestations.WeightDelta{Target: k, Delta: delta})
+			}
+			return res
+		}
+		res = deltas
+	}
+	return res
+}
+
+func (dag *BeaconDag) HeadFn() (common.Hash256, error) {
 	// Make sure changes have been synced
 	if !dag.synced {
-		dag.SyncChanges()
+		if err := dag.SyncChanges(); err != nil {
+			return common.Hash256{}, err
+		}
 	}
 	// return the head
-	return dag.ForkChoice.HeadFn().Key
+	head, err := dag.ForkChoice.HeadFn()
+	if err != nil {
+		return common.Hash256{}, err
+	}
+	return head.Key, nil
+}
+
+/// Computes the LMD-GHOST weight of a node from the latest aggregated attestations:
+//  the sum of all latest votes for the node itself and its descendants, and the proposer boost, if any.
+// Independent of the fork-choice rule, useful for inspection and checking, not for head computation.
+func (dag *BeaconDag) GetWeight(node *DagNode) int64 {
+	weight := int64(0)
+	if node.Invalid {
+		return weight
+	}
+	for t := dag.Nodes[dag.ProposerBoostRoot]; t != nil && t.Slot >= node.Slot; t = t.Parent {
+		if t == node {
+			weight += dag.ProposerBoostWeight
+			break
+		}
+	}
+	for k, v := range dag.agor.Weights() {
+		// walk back from the target, to see if the node is an ancestor
+		for t := dag.Nodes[k]; t != nil && t.Slot >= node.Slot; t = t.Parent {
+			if t == node {
+				weight += int64(v)
+				break
+			}
+		}
+	}
+	return weight
+}
+
+/// The latest message of the validator, if it has one that counts.
+func (dag *BeaconDag) LatestMessage(id common.ValidatorID) (*attestation.Attestation, bool) {
+	return dag.agor.LatestMessage(id)
+}
+
+/// The validators whose latest message votes for the block itself, sorted by ID.
+func (dag *BeaconDag) Voters(blockHash common.Hash256) []common.ValidatorID {
+	return dag.agor.Voters(blockHash)
+}
+
+/// The part of the LMD-GHOST weight of the node (see GetWeight) that comes from the given validators:
+//  their latest votes for the node itself and its descendants. The proposer boost is not included.
+// Validators are expected to be unique.
+func (dag *BeaconDag) WeightFrom(node *DagNode, validators []common.ValidatorID) int64 {
+	weight := int64(0)
+	if node.Invalid {
+		return weight
+	}
+	for _, id := range validators {
+		at, ok := dag.agor.LatestMessage(id)
+		if !ok {
+			continue
+		}
+		if target, ok := dag.Nodes[at.BeaconBlockRoot]; ok && IsAncestor(node, target) {
+			weight += int64(at.Weight)
+		}
+	}
+	return weight
 }
 
 func (dag *BeaconDag) Cleanup() {
@@ -17,6 +17,10 @@ type DagNode struct {
 
 	Slot uint64
 
+	// Checkpoints of the block (from its post-state), to filter viable branches for the head.
+	JustifiedCheckpoint common.Checkpoint
+	FinalizedCheckpoint common.Checkpoint
+
 	// Raw height, a.k.a. distance from genesis in number of blocks. Not used in every implementation.
 	Height uint64
 
@@ -30,5 +34,69 @@ type DagNode struct {
 	// Unused in some implementations
 	IndexAsChild uint32
 
+	// Invalid blocks, and their descendants, are excluded from the head, and their votes do not count.
+	Invalid bool
+
+
+}
+
+/// Checks if a is an ancestor of b, or b itself.
+func IsAncestor(a *DagNode, b *DagNode) bool {
+	for b != nil && b.Slot >= a.Slot {
+		if a == b {
+			return true
+		}
+		b = b.Parent
+	}
+	return false
+}
+
+/// Key for caching ancestor lookups: the key of the block, followed by the (big-endian, 32 bit) slot.
+type AncestorCacheKey [32 + 4]uint8
+
+/// Like the spec get_ancestor: the ancestor of the block at the given slot,
+///  or the latest ancestor before the slot if the slot is empty (or the block itself, if it is not after the slot).
+/// Returns nil if the branch was pruned before reaching the slot.
+/// skips (skip distance (log2) -> block -> ancestor) is used to skip ahead logarithmically:
+///  the furthest skip that does not pass the slot is taken. Results are cached in cache.
+func GetAncestorAtSlot(block *DagNode, slot uint64, skips *[16]map[*DagNode]*DagNode, cache map[AncestorCacheKey]*DagNode) *DagNode {
+	if block.Slot <= slot {
+		return block
+	}
+
+	// construct key
+	cacheKey := AncestorCacheKey{}
+	copy(cacheKey[:32], block.Key[:])
+	cacheKey[32] = uint8(slot >> 24)
+	cacheKey[33] = uint8(slot >> 16)
+	cacheKey[34] = uint8(slot >> 8)
+	cacheKey[35] = uint8(slot)
+
+	// check cache
+	if res, ok := cache[cacheKey]; ok {
+		// hit!
+		return res
+	}
+
+	// skips get longer with i, take the furthest one that is still after the slot, or the parent otherwise.
+	next := block.Parent
+	for i := 15; i > 0; i-- {
+		if skipBlock := skips[i][block]; skipBlock != nil && skipBlock.Slot > slot {
+			next = skipBlock
+			break
+		}
+	}
+	if next == nil {
+		// the branch was disconnected from the justified part of the DAG by pruning, there is no ancestor.
+		return nil
+	}
+	o := GetAncestorAtSlot(next, slot, skips, cache)
+	if o == nil {
+		return nil
+	}
+
+	// cache this, so we never have to handle beyond this point again.
+	cache[cacheKey] = o
 
+	return o
 }
@@ -1,15 +1,44 @@
 package dag
 
+import "bytes"
+
 type ScoreChange struct {
 	Target *DagNode
 	ScoreDelta int64
 }
 
+/// Every fork-choice rule must choose between children with the same tie-breaking policy, see IsPreferred.
+/// This keeps heads reproducible, across rules and across runs.
+/// And every rule must exclude branches that are not viable for the head, see BeaconDag.IsViable.
+/// Errors are returned when the rule finds its own state inconsistent (e.g. a negative weight),
+///  the rule, and the dag using it, should not be trusted anymore after that.
 type ForkChoice interface {
-	OnNewNode(node *DagNode)
-	ApplyScoreChanges(changes []ScoreChange)
-	OnPrune()
-	HeadFn() *DagNode
+	OnNewNode(node *DagNode) error
+	ApplyScoreChanges(changes []ScoreChange) error
+	OnPrune() error
+	// Called when the justified or finalized checkpoint changed, i.e. when the viability of branches may have changed.
+	OnCheckpointsChange() error
+	// Called when the node and all its descendants became invalid (see DagNode.Invalid).
+	// Their weight has already been removed with score changes, before they were marked invalid.
+	OnInvalidate(node *DagNode) error
+	HeadFn() (*DagNode, error)
 }
 
 type InitForkChoice func(dag *BeaconDag) ForkChoice
+
+/// The tie-breaking policy, shared by all fork-choice rules:
+/// The child with the highest weight is preferred. If the weights are equal,
+///  the child with the lexicographically highest block hash is preferred, like the spec.
+/// Returns true if a (weighted aWeight) is preferred over b (weighted bWeight).
+func IsPreferred(a *DagNode, aWeight int64, b *DagNode, bWeight int64) bool {
+	if aWeight != bWeight {
+		return aWeight > bWeight
+	}
+	return bytes.Compare(a.Key[:], b.Key[:]) > 0
+}
+
+/// Optional, for fork-choice rules where latest messages expire (e.g. RLMD-GHOST, Goldfish).
+/// Returns the earliest slot of which votes still count, at the given current slot.
+type VoteExpiry interface {
+	MinVoteSlot(slot uint64) uint64
+}
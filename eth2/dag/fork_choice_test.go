@@ -0,0 +1,66 @@
+package dag_test
+
+import (
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"lmd-ghost/eth2/fork_choice/choices/vote_expiry"
+	"testing"
+)
+
+// The LMD-GHOST rules, and the rules with expiring votes: all of them share the tie-breaking policy.
+func allRules() map[string]dag.InitForkChoice {
+	res := map[string]dag.InitForkChoice{
+		"vote_expiry": vote_expiry.NewVoteExpiryLMDGhost(constants.EPOCH_LENGTH),
+		"goldfish":    vote_expiry.NewVoteExpiryLMDGhost(1),
+	}
+	for name, initForkChoice := range lmdGhostRules {
+		res[name] = initForkChoice
+	}
+	return res
+}
+
+// Two children of equal weight: every rule must pick the child IsPreferred picks, the one with the highest hash,
+//  whatever the order the children were added in.
+func TestTieBreak(t *testing.T) {
+	for name, initForkChoice := range allRules() {
+		for _, votes := range []int{0, 1} {
+			for _, highFirst := range []bool{false, true} {
+				d := dag.NewBeaconDag(initForkChoice)
+				genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+				g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+					JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+				low := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{0x80, 1}, Slot: g.Slot + 1,
+					JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+				high := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{0x80, 2}, Slot: g.Slot + 1,
+					JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+				blockIn(t, d, g)
+				if highFirst {
+					blockIn(t, d, high)
+					blockIn(t, d, low)
+				} else {
+					blockIn(t, d, low)
+					blockIn(t, d, high)
+				}
+				d.OnSlot(g.Slot + 1)
+				for i := 0; i < votes; i++ {
+					vote(d, common.ValidatorID(2 * i), low)
+					vote(d, common.ValidatorID(2 * i + 1), high)
+				}
+				lowNode, highNode := d.Nodes[low.Hash], d.Nodes[high.Hash]
+				if d.GetWeight(lowNode) != d.GetWeight(highNode) || !dag.IsPreferred(highNode, 0, lowNode, 0) {
+					t.Fatal("expected the children to weigh the same, and the child with the highest hash to be preferred")
+				}
+				head, err := d.HeadFn()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if head != high.Hash {
+					t.Errorf("%s (%d votes per child, highest hash first: %v): expected head %s, got %s",
+						name, votes, highFirst, high.Hash, head)
+				}
+			}
+		}
+	}
+}
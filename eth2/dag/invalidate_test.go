@@ -0,0 +1,76 @@
+package dag_test
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"testing"
+)
+
+// g <- x <- a <- a2, and x <- b, x <- c: a is the best child of x, until it is invalidated.
+// Then the head moves to its sibling b, also when a2 gets more votes later, and follows the votes between b and c.
+// When all children of x are invalid, x is the head.
+func TestInvalidateBestChild(t *testing.T) {
+	for name, initForkChoice := range allRules() {
+		t.Run(name, func(t *testing.T) {
+			d := dag.NewBeaconDag(initForkChoice)
+			genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+			g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			x := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{2}, Slot: g.Slot + 1,
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			a := &block.BeaconBlock{ParentHash: x.Hash, Hash: common.Hash256{3}, Slot: g.Slot + 2,
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			a2 := &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{4}, Slot: g.Slot + 3,
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			b := &block.BeaconBlock{ParentHash: x.Hash, Hash: common.Hash256{5}, Slot: g.Slot + 2,
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			c := &block.BeaconBlock{ParentHash: x.Hash, Hash: common.Hash256{6}, Slot: g.Slot + 2,
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			for _, bl := range []*block.BeaconBlock{g, x, a, a2, b, c} {
+				blockIn(t, d, bl)
+			}
+			d.OnSlot(a2.Slot)
+			for id := common.ValidatorID(0); id < 3; id++ {
+				vote(d, id, a2)
+			}
+			// (all votes in the current slot, so they do not expire)
+			d.AttestationIn(&attestation.Attestation{BeaconBlockRoot: b.Hash, Attester: 3, Slot: a2.Slot, Weight: 1})
+
+			expectHead := func(expected common.Hash256) {
+				t.Helper()
+				head, err := d.HeadFn()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if head != expected {
+					t.Fatalf("expected head %s, got %s", expected, head)
+				}
+			}
+			expectHead(a2.Hash)
+			if err := d.InvalidateBlock(a.Hash); err != nil {
+				t.Fatal(err)
+			}
+			expectHead(b.Hash)
+			// votes for the invalid branch do not count
+			for id := common.ValidatorID(4); id < 7; id++ {
+				vote(d, id, a2)
+			}
+			expectHead(b.Hash)
+			// the valid siblings still follow their votes
+			d.AttestationIn(&attestation.Attestation{BeaconBlockRoot: c.Hash, Attester: 3, Slot: a2.Slot + 1, Weight: 1})
+			expectHead(c.Hash)
+			// once all children are invalid, their parent is a leaf, and the head
+			if err := d.InvalidateBlock(c.Hash); err != nil {
+				t.Fatal(err)
+			}
+			expectHead(b.Hash)
+			if err := d.InvalidateBlock(b.Hash); err != nil {
+				t.Fatal(err)
+			}
+			expectHead(x.Hash)
+		})
+	}
+}
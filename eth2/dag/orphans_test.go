@@ -0,0 +1,114 @@
+package dag_test
+
+import (
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"lmd-ghost/eth2/fork_choice/choices/spec"
+	"testing"
+)
+
+func TestOrphanLimit(t *testing.T) {
+	d := dag.NewBeaconDag(spec.NewSpecLMDGhost)
+	d.OrphanLimit = 2
+	var dropped []common.Hash256
+	d.OrphanDropped = func(bl *block.BeaconBlock) {
+		dropped = append(dropped, bl.Hash)
+	}
+	blockIn(t, d, &block.BeaconBlock{Hash: common.Hash256{1}, Slot: constants.GENESIS_SLOT})
+	missing := common.Hash256{2}
+	for i := uint8(0); i < 3; i++ {
+		orphan := &block.BeaconBlock{ParentHash: missing, Hash: common.Hash256{3, i}, Slot: constants.GENESIS_SLOT + 2}
+		res, err := d.BlockIn(orphan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := dag.BlockQueuedAsOrphan
+		if i == 2 {
+			expected = dag.BlockDroppedAsOrphan
+		}
+		if res != expected {
+			t.Fatalf("orphan %d: expected %s, got %s", i, expected, res)
+		}
+	}
+	if d.OrphanCount() != 2 || d.OrphansDropped != 1 {
+		t.Fatalf("expected 2 orphans and 1 dropped, got %d and %d", d.OrphanCount(), d.OrphansDropped)
+	}
+	if len(dropped) != 1 || dropped[0] != (common.Hash256{3, 2}) {
+		t.Fatalf("expected the last orphan to be reported as dropped, got %v", dropped)
+	}
+	// the queued orphans are imported with their parent
+	blockIn(t, d, &block.BeaconBlock{ParentHash: common.Hash256{1}, Hash: missing, Slot: constants.GENESIS_SLOT + 1})
+	if d.OrphanCount() != 0 || len(d.Nodes) != 4 {
+		t.Fatalf("expected the orphans to be imported, got %d orphans and %d nodes", d.OrphanCount(), len(d.Nodes))
+	}
+}
+
+func TestOrphanNotAfterParent(t *testing.T) {
+	d := dag.NewBeaconDag(spec.NewSpecLMDGhost)
+	var dropped []common.Hash256
+	d.OrphanDropped = func(bl *block.BeaconBlock) {
+		dropped = append(dropped, bl.Hash)
+	}
+	g := &block.BeaconBlock{Hash: common.Hash256{1}, Slot: constants.GENESIS_SLOT}
+	blockIn(t, d, g)
+	p := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{2}, Slot: g.Slot + 2}
+	// x is not after its parent, y waits for x
+	x := &block.BeaconBlock{ParentHash: p.Hash, Hash: common.Hash256{3}, Slot: g.Slot + 2}
+	y := &block.BeaconBlock{ParentHash: x.Hash, Hash: common.Hash256{4}, Slot: g.Slot + 3}
+	for _, b := range []*block.BeaconBlock{x, y} {
+		if res, err := d.BlockIn(b); err != nil || res != dag.BlockQueuedAsOrphan {
+			t.Fatalf("expected block %s to be queued as orphan, got %s %v", b.Hash, res, err)
+		}
+	}
+	blockIn(t, d, p)
+	if d.OrphanCount() != 0 || len(d.Nodes) != 2 {
+		t.Fatalf("expected the orphans to be dropped, got %d orphans and %d nodes", d.OrphanCount(), len(d.Nodes))
+	}
+	if len(dropped) != 2 || dropped[0] != x.Hash || dropped[1] != y.Hash {
+		t.Fatalf("expected the orphan and its child to be reported as dropped, got %v", dropped)
+	}
+}
+
+func TestOrphansConflictingWithFinality(t *testing.T) {
+	d := dag.NewBeaconDag(spec.NewSpecLMDGhost)
+	var dropped []common.Hash256
+	d.OrphanDropped = func(bl *block.BeaconBlock) {
+		dropped = append(dropped, bl.Hash)
+	}
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+	g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	// s is a sibling of the finalized block f, after it: it stays in the DAG after finalization.
+	s := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{2}, Slot: g.Slot + constants.EPOCH_LENGTH + 1}
+	f := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{3}, Slot: g.Slot + constants.EPOCH_LENGTH}
+	for _, b := range []*block.BeaconBlock{g, s, f} {
+		blockIn(t, d, b)
+	}
+	// a is at the finalized slot, b waits for it. x is after the finalized slot, but descends from s.
+	p := &block.BeaconBlock{ParentHash: s.Hash, Hash: common.Hash256{4}, Slot: s.Slot + 1}
+	a := &block.BeaconBlock{ParentHash: common.Hash256{9}, Hash: common.Hash256{5}, Slot: f.Slot}
+	b := &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{6}, Slot: f.Slot + 10}
+	x := &block.BeaconBlock{ParentHash: p.Hash, Hash: common.Hash256{7}, Slot: p.Slot + 1}
+	for _, o := range []*block.BeaconBlock{a, b, x} {
+		if res, err := d.BlockIn(o); err != nil || res != dag.BlockQueuedAsOrphan {
+			t.Fatalf("expected block %s to be queued as orphan, got %s %v", o.Hash, res, err)
+		}
+	}
+	cp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH + 1, Root: f.Hash}
+	if err := d.Justify(cp); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Finalize(cp); err != nil {
+		t.Fatal(err)
+	}
+	if d.OrphanCount() != 1 || len(dropped) != 2 || dropped[0] != a.Hash || dropped[1] != b.Hash {
+		t.Fatalf("expected the orphan at the finalized slot and its child to be dropped, got %d orphans, dropped %v", d.OrphanCount(), dropped)
+	}
+	// the DAG does not validate p itself (the chain does), but its orphan is checked against finality.
+	blockIn(t, d, p)
+	if _, ok := d.Nodes[x.Hash]; ok || d.OrphanCount() != 0 || len(dropped) != 3 || dropped[2] != x.Hash {
+		t.Fatalf("expected the orphan that does not descend from the finalized block to be dropped, got %d orphans, dropped %v", d.OrphanCount(), dropped)
+	}
+}
@@ -0,0 +1,50 @@
+package dag_test
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"testing"
+)
+
+// A new block b, competing with the voted block a: the boost makes b the head, until it expires.
+func TestProposerBoost(t *testing.T) {
+	for name, initForkChoice := range allRules() {
+		t.Run(name, func(t *testing.T) {
+			d := dag.NewBeaconDag(initForkChoice)
+			genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+			g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			a := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{3}, Slot: g.Slot + 1,
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			b := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{2}, Slot: g.Slot + 2,
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			for _, bl := range []*block.BeaconBlock{g, a, b} {
+				blockIn(t, d, bl)
+			}
+			d.AttestationIn(&attestation.Attestation{BeaconBlockRoot: a.Hash, Attester: 1, Slot: a.Slot, Weight: 10})
+
+			expectHead := func(expected common.Hash256) {
+				t.Helper()
+				head, err := d.HeadFn()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if head != expected {
+					t.Fatalf("expected head %s, got %s", expected, head)
+				}
+			}
+			expectHead(a.Hash)
+			// 40% of 100 outweighs the vote for a
+			d.ApplyProposerBoost(b.Hash, 100)
+			if w := d.GetWeight(d.Nodes[b.Hash]); w != 40 {
+				t.Fatalf("expected the boosted block to weigh 40, got %d", w)
+			}
+			expectHead(b.Hash)
+			d.ExpireProposerBoost()
+			expectHead(a.Hash)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package dag
+
+import "lmd-ghost/eth2/common/constants"
+
+/// A leaf is only viable for the head if it agrees with the justified and finalized checkpoints of the store,
+///  both the epochs and the roots.
+/// Like filter_block_tree in the spec, nothing is filtered when the store is still at genesis.
+/// Invalid blocks are never viable.
+func (dag *BeaconDag) IsViableLeaf(n *DagNode) bool {
+	if n.Invalid {
+		return false
+	}
+	justified := dag.JustifiedCheckpoint
+	finalized := dag.FinalizedCheckpoint
+	return (justified.Epoch == constants.GENESIS_EPOCH || n.JustifiedCheckpoint == justified) &&
+		(finalized.Epoch == constants.GENESIS_EPOCH || n.FinalizedCheckpoint == finalized)
+}
+
+/// Checks if the node is part of the filtered block-tree:
+///  it is the justified node or one of its descendants, and it leads to a viable leaf.
+func (dag *BeaconDag) IsViable(n *DagNode) bool {
+	if dag.viable == nil {
+		dag.filterBlockTree()
+	}
+	return dag.viable[n]
+}
+
+func (dag *BeaconDag) filterBlockTree() {
+	dag.viable = make(map[*DagNode]bool)
+	// breadth-first order: every node comes after its parent
+	order := []*DagNode{dag.Justified}
+	for i := 0; i < len(order); i++ {
+		order = append(order, order[i].Children...)
+	}
+	// process in reverse order: children before their parents
+	for i := len(order) - 1; i >= 0; i-- {
+		n := order[i]
+		if n.Invalid {
+			dag.viable[n] = false
+			continue
+		}
+		// invalid children do not count, a node with only invalid children is a leaf.
+		leaf := true
+		viable := false
+		for _, c := range n.Children {
+			if c.Invalid {
+				continue
+			}
+			leaf = false
+			if dag.viable[c] {
+				viable = true
+				break
+			}
+		}
+		if leaf {
+			viable = dag.IsViableLeaf(n)
+		}
+		dag.viable[n] = viable
+	}
+}
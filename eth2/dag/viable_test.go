@@ -0,0 +1,106 @@
+package dag_test
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"lmd-ghost/eth2/fork_choice/choices/cached"
+	"lmd-ghost/eth2/fork_choice/choices/proto_array"
+	"lmd-ghost/eth2/fork_choice/choices/simple_back_prop"
+	"lmd-ghost/eth2/fork_choice/choices/spec"
+	"lmd-ghost/eth2/fork_choice/choices/stateful"
+	"lmd-ghost/eth2/fork_choice/choices/vitalik"
+	"testing"
+)
+
+var lmdGhostRules = map[string]dag.InitForkChoice{
+	"spec":               spec.NewSpecLMDGhost,
+	"vitalik":            vitalik.NewVitaliksOptimizedLMDGhost,
+	"cached":             cached.NewCachedLMDGhost,
+	"simple_back_prop":   simple_back_prop.NewSimpleBackPropLMDGhost,
+	"stateful":           stateful.NewStatefulLMDGhost,
+	"proto_array":        proto_array.NewProtoArrayLMDGhost,
+	"proto_array_offset": proto_array.NewProtoArrayOffsetLMDGhost,
+	"proto_array_lazy":   proto_array.NewProtoArrayLazyLMDGhost,
+}
+
+func blockIn(t *testing.T, d *dag.BeaconDag, b *block.BeaconBlock) {
+	if res, err := d.BlockIn(b); err != nil || res != dag.BlockImported {
+		t.Fatalf("block %s not imported: %v %v", b.Hash, res, err)
+	}
+}
+
+func vote(d *dag.BeaconDag, id common.ValidatorID, b *block.BeaconBlock) {
+	d.AttestationIn(&attestation.Attestation{BeaconBlockRoot: b.Hash, Attester: id, Slot: b.Slot, Weight: 1})
+}
+
+// Two branches from the justified block A: X agrees with the justified checkpoint, Y carries a conflicting justification:
+//  an older one, or one of the same epoch with another root (A was skipped in the branch of Y, it justified G instead).
+// Y is heavier, but only X is viable once A is justified.
+func TestConflictingJustification(t *testing.T) {
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+	conflicts := []struct {
+		name string
+		cp common.Checkpoint
+	}{
+		{"older epoch", genesisCp},
+		{"same epoch other root", common.Checkpoint{Epoch: constants.GENESIS_EPOCH + 1, Root: genesisCp.Root}},
+	}
+	for _, conflict := range conflicts {
+		for name, initForkChoice := range lmdGhostRules {
+			yCp := conflict.cp
+			t.Run(conflict.name + "/" + name, func(t *testing.T) {
+				d := dag.NewBeaconDag(initForkChoice)
+				g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+					JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+				blockIn(t, d, g)
+
+				a := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{2}, Slot: g.Slot + constants.EPOCH_LENGTH,
+					JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+				blockIn(t, d, a)
+				aCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH + 1, Root: a.Hash}
+
+				x1 := &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{3}, Slot: a.Slot + 1,
+					JustifiedCheckpoint: aCp, FinalizedCheckpoint: genesisCp}
+				x2 := &block.BeaconBlock{ParentHash: x1.Hash, Hash: common.Hash256{4}, Slot: a.Slot + 2,
+					JustifiedCheckpoint: aCp, FinalizedCheckpoint: genesisCp}
+				y1 := &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{5}, Slot: a.Slot + 1,
+					JustifiedCheckpoint: yCp, FinalizedCheckpoint: genesisCp}
+				y2 := &block.BeaconBlock{ParentHash: y1.Hash, Hash: common.Hash256{6}, Slot: a.Slot + 3,
+					JustifiedCheckpoint: yCp, FinalizedCheckpoint: genesisCp}
+				for _, b := range []*block.BeaconBlock{x1, x2, y1, y2} {
+					blockIn(t, d, b)
+				}
+				vote(d, 1, x2)
+				for id := common.ValidatorID(2); id < 5; id++ {
+					vote(d, id, y2)
+				}
+
+				// nothing is filtered at genesis, the heavier branch wins
+				head, err := d.HeadFn()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if head != y2.Hash {
+					t.Fatalf("expected heavier head %s before justification, got %s", y2.Hash, head)
+				}
+
+				if err := d.Justify(aCp); err != nil {
+					t.Fatal(err)
+				}
+				head, err = d.HeadFn()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if wx, wy := d.GetWeight(d.Nodes[x1.Hash]), d.GetWeight(d.Nodes[y1.Hash]); wy <= wx {
+					t.Fatalf("expected the non-viable branch to be heavier, got %d (viable) and %d", wx, wy)
+				}
+				if head != x2.Hash {
+					t.Fatalf("expected head %s on the viable branch, got %s", x2.Hash, head)
+				}
+			})
+		}
+	}
+}
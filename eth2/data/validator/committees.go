@@ -0,0 +1,101 @@
+package validator
+
+import (
+	"fmt"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"math/rand"
+)
+
+/// The committee assignments of an epoch: the active validators, shuffled, and split into committees.
+type epochCommittees struct {
+
+	shuffled []*Validator
+
+	committeesPerSlot uint64
+}
+
+func (c *epochCommittees) committee(slot uint64, index uint64) []*Validator {
+	count := c.committeesPerSlot * constants.EPOCH_LENGTH
+	k := (slot % constants.EPOCH_LENGTH) * c.committeesPerSlot + index
+	n := uint64(len(c.shuffled))
+	return c.shuffled[n * k / count : n * (k + 1) / count]
+}
+
+/// Like the spec: enough committees per slot to reach the target committee size, within the limits.
+func committeesPerSlot(activeCount uint64) uint64 {
+	res := activeCount / constants.EPOCH_LENGTH / constants.TARGET_COMMITTEE_SIZE
+	if res > constants.MAX_COMMITTEES_PER_SLOT {
+		res = constants.MAX_COMMITTEES_PER_SLOT
+	}
+	if res < 1 {
+		res = 1
+	}
+	return res
+}
+
+func (r *Registry) computeCommittees(epoch uint64) *epochCommittees {
+	active := make([]common.ValidatorID, 0, len(r.validators))
+	for id, v := range r.validators {
+		if v.IsActive(epoch) {
+			active = append(active, id)
+		}
+	}
+	sortIDs(active)
+	shuffled := make([]*Validator, len(active))
+	for i, id := range active {
+		shuffled[i] = r.validators[id]
+	}
+	// [divergence from spec: a seeded shuffle instead of the swap-or-not shuffle with the RANDAO mix]
+	rng := rand.New(rand.NewSource(int64(epoch)))
+	rng.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	res := &epochCommittees{
+		shuffled: shuffled,
+		committeesPerSlot: committeesPerSlot(uint64(len(active))),
+	}
+	return res
+}
+
+/// The amount of committees per slot, in the epoch of the slot.
+func (r *Registry) CommitteeCount(slot uint64) (uint64, error) {
+	c, err := r.getCommittees(slot / constants.EPOCH_LENGTH)
+	if err != nil {
+		return 0, err
+	}
+	return c.committeesPerSlot, nil
+}
+
+/// The members of the committee, in committee order (the order of the aggregation bits).
+/// Committees are known for past epochs, the current epoch, and the next epoch.
+func (r *Registry) Committee(slot uint64, index uint64) ([]*Validator, error) {
+	c, err := r.getCommittees(slot / constants.EPOCH_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+	if index >= c.committeesPerSlot {
+		return nil, fmt.Errorf("committee index %d is out of range, slot %d has %d committees", index, slot, c.committeesPerSlot)
+	}
+	return c.committee(slot, index), nil
+}
+
+func (r *Registry) getCommittees(epoch uint64) (*epochCommittees, error) {
+	if epoch > r.epoch + 1 {
+		return nil, fmt.Errorf("committees of epoch %d are not known yet, current epoch is %d", epoch, r.epoch)
+	}
+	if c, ok := r.committees[epoch]; ok {
+		return c, nil
+	}
+	c := r.computeCommittees(epoch)
+	r.committees[epoch] = c
+	return c, nil
+}
+
+/// Committees are computed from the validators active in their epoch,
+///  a change of the validator set makes the computed committees outdated.
+func (r *Registry) resetCommittees() {
+	if len(r.committees) > 0 {
+		r.committees = make(map[uint64]*epochCommittees)
+	}
+}
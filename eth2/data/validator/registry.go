@@ -0,0 +1,176 @@
+package validator
+
+import (
+	"fmt"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"sort"
+)
+
+/// All known validators. The effective balance of an active validator is the weight of its attestations.
+type Registry struct {
+
+	validators map[common.ValidatorID]*Validator
+
+	// The current epoch, validators are active or not relative to this epoch.
+	epoch uint64
+
+	// Sum of the effective balances of the active validators.
+	totalActiveBalance uint64
+
+	// epoch -> validators that activate or exit at the epoch, processed when the epoch starts (see SetEpoch).
+	activations map[uint64][]common.ValidatorID
+	exits       map[uint64][]common.ValidatorID
+
+	// epoch -> committee assignments, computed when needed (see Committee).
+	committees map[uint64]*epochCommittees
+}
+
+func NewRegistry(epoch uint64) *Registry {
+	res := &Registry{
+		validators:  make(map[common.ValidatorID]*Validator),
+		epoch:       epoch,
+		activations: make(map[uint64][]common.ValidatorID),
+		exits:       make(map[uint64][]common.ValidatorID),
+		committees:  make(map[uint64]*epochCommittees),
+	}
+	return res
+}
+
+/// Adds the validator. It contributes weight from its activation epoch, which may be in the future.
+func (r *Registry) Add(v *Validator) error {
+	if _, ok := r.validators[v.Id]; ok {
+		return fmt.Errorf("validator %d is already registered", v.Id)
+	}
+	if v.ExitEpoch <= v.ActivationEpoch {
+		return fmt.Errorf("validator %d exits (epoch %d) before it activates (epoch %d)", v.Id, v.ExitEpoch, v.ActivationEpoch)
+	}
+	r.validators[v.Id] = v
+	r.resetCommittees()
+	if v.IsActive(r.epoch) {
+		r.totalActiveBalance += v.EffectiveBalance()
+	}
+	if v.ActivationEpoch > r.epoch {
+		r.activations[v.ActivationEpoch] = append(r.activations[v.ActivationEpoch], v.Id)
+	}
+	if v.ExitEpoch != constants.FAR_FUTURE_EPOCH && v.ExitEpoch > r.epoch {
+		r.exits[v.ExitEpoch] = append(r.exits[v.ExitEpoch], v.Id)
+	}
+	return nil
+}
+
+/// Schedules the exit of the validator, at a future epoch. It stops contributing weight when the exit epoch starts.
+func (r *Registry) Exit(id common.ValidatorID, exitEpoch uint64) error {
+	v, ok := r.validators[id]
+	if !ok {
+		return fmt.Errorf("cannot exit unknown validator %d", id)
+	}
+	if v.ExitEpoch != constants.FAR_FUTURE_EPOCH {
+		return fmt.Errorf("validator %d is already exiting, at epoch %d", id, v.ExitEpoch)
+	}
+	if exitEpoch <= r.epoch || exitEpoch <= v.ActivationEpoch {
+		return fmt.Errorf("exit epoch %d of validator %d is not after the current epoch %d and its activation epoch %d",
+			exitEpoch, id, r.epoch, v.ActivationEpoch)
+	}
+	v.ExitEpoch = exitEpoch
+	r.resetCommittees()
+	r.exits[exitEpoch] = append(r.exits[exitEpoch], id)
+	return nil
+}
+
+/// Starts the given epoch: scheduled activations and exits take effect.
+/// Returns the validators that became active, and those that exited, sorted by ID.
+func (r *Registry) SetEpoch(epoch uint64) (activated []common.ValidatorID, exited []common.ValidatorID) {
+	if epoch <= r.epoch {
+		return nil, nil
+	}
+	prevEpoch := r.epoch
+	r.epoch = epoch
+	// committees of old epochs are not needed anymore, attestations for them are too old to matter.
+	for e := range r.committees {
+		if e + 1 < epoch {
+			delete(r.committees, e)
+		}
+	}
+	// a validator may both activate and exit when multiple epochs pass at once, compare before and after.
+	changed := make(map[common.ValidatorID]bool)
+	for _, queue := range []map[uint64][]common.ValidatorID{r.activations, r.exits} {
+		for e, ids := range queue {
+			if e > epoch {
+				continue
+			}
+			for _, id := range ids {
+				changed[id] = true
+			}
+			// deletion during map iteration, safe in Go
+			delete(queue, e)
+		}
+	}
+	for id := range changed {
+		v := r.validators[id]
+		wasActive, isActive := v.IsActive(prevEpoch), v.IsActive(epoch)
+		if !wasActive && isActive {
+			r.totalActiveBalance += v.EffectiveBalance()
+			activated = append(activated, id)
+		} else if wasActive && !isActive {
+			r.totalActiveBalance -= v.EffectiveBalance()
+			exited = append(exited, id)
+		}
+	}
+	sortIDs(activated)
+	sortIDs(exited)
+	return activated, exited
+}
+
+func sortIDs(ids []common.ValidatorID) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+}
+
+func (r *Registry) Epoch() uint64 {
+	return r.epoch
+}
+
+func (r *Registry) Get(id common.ValidatorID) (*Validator, bool) {
+	v, ok := r.validators[id]
+	return v, ok
+}
+
+func (r *Registry) IsActive(id common.ValidatorID) bool {
+	v, ok := r.validators[id]
+	return ok && v.IsActive(r.epoch)
+}
+
+/// The effective balance of the validator, false if the validator is not known, or not active.
+func (r *Registry) ActiveBalance(id common.ValidatorID) (uint64, bool) {
+	v, ok := r.validators[id]
+	if !ok || !v.IsActive(r.epoch) {
+		return 0, false
+	}
+	return v.EffectiveBalance(), true
+}
+
+/// Changes the balance of the validator. Returns true if the effective balance changed.
+func (r *Registry) SetBalance(id common.ValidatorID, balance uint64) (bool, error) {
+	v, ok := r.validators[id]
+	if !ok {
+		return false, fmt.Errorf("cannot change balance of unknown validator %d", id)
+	}
+	prev := v.EffectiveBalance()
+	v.Balance = balance
+	now := v.EffectiveBalance()
+	if v.IsActive(r.epoch) {
+		r.totalActiveBalance = r.totalActiveBalance - prev + now
+	}
+	return prev != now, nil
+}
+
+/// The sum of the effective balances of the active validators.
+func (r *Registry) TotalActiveBalance() uint64 {
+	return r.totalActiveBalance
+}
+
+func (r *Registry) Count() int {
+	return len(r.validators)
+}
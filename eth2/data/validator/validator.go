@@ -1,13 +1,45 @@
 package validator
 
-import "lmd-ghost/eth2/common"
+import (
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+)
 
 type Validator struct {
 
 	// this would be the pub-key (or a reference of one) in a real implementation
 	Id common.ValidatorID
 
+	// in Gwei
 	Balance uint64
 
-	// TODO implement entries/exits?
+	// The validator is active from the activation epoch, up to (excluding) the exit epoch.
+	// Only active validators contribute weight.
+	ActivationEpoch uint64
+	ExitEpoch       uint64
+}
+
+/// Creates a validator that activates at the given epoch, and does not exit.
+func NewValidator(id common.ValidatorID, balance uint64, activationEpoch uint64) *Validator {
+	res := &Validator{
+		Id:              id,
+		Balance:         balance,
+		ActivationEpoch: activationEpoch,
+		ExitEpoch:       constants.FAR_FUTURE_EPOCH,
+	}
+	return res
+}
+
+/// The balance that counts as attestation weight: rounded down to whole increments, and capped, like the spec.
+/// (The hysteresis of the spec is left out, the effective balance follows the balance directly)
+func (v *Validator) EffectiveBalance() uint64 {
+	res := v.Balance - v.Balance % constants.EFFECTIVE_BALANCE_INCREMENT
+	if res > constants.MAX_EFFECTIVE_BALANCE {
+		res = constants.MAX_EFFECTIVE_BALANCE
+	}
+	return res
+}
+
+func (v *Validator) IsActive(epoch uint64) bool {
+	return v.ActivationEpoch <= epoch && epoch < v.ExitEpoch
 }
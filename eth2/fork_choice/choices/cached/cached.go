@@ -2,19 +2,9 @@ package cached
 
 import (
 	"lmd-ghost/eth2/dag"
+	"sort"
 )
 
-type CacheKey [32 + 4]uint8
-
-// Trick to get a quick conversion array, gets the log of a number
-const logzLen = 10000
-var logz = [logzLen]uint8{0, 0}
-func init() {
-	for i := 2; i < logzLen; i++ {
-		logz[i] = logz[i / 2] + 1
-	}
-}
-
 /// Just only the cache part of the implementation of Vitalik
 type CachedLMDGhost struct {
 
@@ -22,9 +12,10 @@ type CachedLMDGhost struct {
 
 	latestScores map[*dag.DagNode]int64
 
-	cache map[CacheKey]*dag.DagNode
+	// block-ref + slot -> ancestor (at the slot, or the latest before it)
+	cache map[dag.AncestorCacheKey]*dag.DagNode
 
-	// slot -> hash -> ancestor
+	// skip distance (log2) -> block-ref -> ancestor, based on heights
 	ancestors [16]map[*dag.DagNode]*dag.DagNode
 
 }
@@ -33,7 +24,7 @@ func NewCachedLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
 	res := &CachedLMDGhost{
 		dag:          d,
 		latestScores: make(map[*dag.DagNode]int64),
-		cache: make(map[CacheKey]*dag.DagNode),
+		cache: make(map[dag.AncestorCacheKey]*dag.DagNode),
 		ancestors: [16]map[*dag.DagNode]*dag.DagNode{},
 	}
 	for i := uint8(0); i < 16; i++ {
@@ -42,52 +33,7 @@ func NewCachedLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
 	return res
 }
 
-/// Similar to the spec get_ancestor,
-/// but using height instead of slot numbers to enable skipping ahead logarithmically, and with caching.
-func (gh *CachedLMDGhost) getAncestor(block *dag.DagNode, height uint64) *dag.DagNode {
-
-	if height >= block.Height {
-		if height > block.Height {
-			return nil
-		} else {
-			return block
-		}
-	}
-
-	// construct key
-	cacheKey := CacheKey{}
-	copy(cacheKey[:32], block.Key[:])
-	cacheKey[32] = uint8(height >> 24)
-	cacheKey[33] = uint8(height >> 16)
-	cacheKey[34] = uint8(height >> 8)
-	cacheKey[35] = uint8(height)
-
-	// check cache
-	if res, ok := gh.cache[cacheKey]; ok {
-		// hit!
-		return res
-	}
-
-	if x := gh.ancestors[logz[block.Height - height - 1]][block]; x == nil {
-		panic("Ancestors data is invalid")
-	}
-
-	// this will be the output
-	// skip ahead logarithmically to find the ancestor, and dive in recursively
-	skipBlock := gh.ancestors[logz[block.Height - height - 1]][block]
-	o := gh.getAncestor(skipBlock, height)
-
-	if o.Height != height {
-		panic("Found ancestor is at wrong height")
-	}
-
-	// cache this, so we never have to handle beyond this point again.
-	gh.cache[cacheKey] = o
-
-	return o
-}
-
-func (gh *CachedLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
+func (gh *CachedLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) error {
 	for _, v := range changes {
 		if v.Target.Slot >= gh.dag.Finalized.Slot {
 			gh.latestScores[v.Target] += v.ScoreDelta
@@ -100,9 +46,10 @@ func (gh *CachedLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
 			delete(gh.latestScores, k)
 		}
 	}
+	return nil
 }
 
-func (gh *CachedLMDGhost) OnNewNode(block *dag.DagNode) {
+func (gh *CachedLMDGhost) OnNewNode(block *dag.DagNode) error {
 	startHeight := gh.dag.Finalized.Height
 	// update the ancestor data (used for logarithmic lookup)
 	for i := uint8(0); i < 16; i++ {
@@ -112,9 +59,20 @@ func (gh *CachedLMDGhost) OnNewNode(block *dag.DagNode) {
 			gh.ancestors[i][block] = gh.ancestors[i][block.Parent]
 		}
 	}
+	return nil
+}
+
+func (gh *CachedLMDGhost) OnCheckpointsChange() error {
+	// nothing to do, branches are filtered when computing the head
+	return nil
+}
+
+func (gh *CachedLMDGhost) OnInvalidate(node *dag.DagNode) error {
+	// nothing to do, invalid branches are not viable, and are filtered when computing the head
+	return nil
 }
 
-func (gh *CachedLMDGhost) OnPrune() {
+func (gh *CachedLMDGhost) OnPrune() error {
 	minSlot := gh.dag.Finalized.Slot
 	// prune old latest_scores
 	for k := range gh.latestScores {
@@ -130,22 +88,29 @@ func (gh *CachedLMDGhost) OnPrune() {
 		}
 	}
 	// prune away old ancestor data
-	for _, ancMap := range gh.ancestors {
-		for k, v := range ancMap {
-			if v.Slot < minSlot {
-				delete(ancMap, k)
-			}
-		}
+	for i := range gh.ancestors {
+		gh.ancestors[i] = make(map[*dag.DagNode]*dag.DagNode)
 	}
-	// now update all ancestor data.
+	// now update all ancestor data, relative to the new finalized height.
+	// Parents have to be updated before their children.
+	nodes := make([]*dag.DagNode, 0, len(gh.dag.Nodes))
 	for _, v := range gh.dag.Nodes {
-		gh.OnNewNode(v)
+		nodes = append(nodes, v)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Height < nodes[j].Height
+	})
+	for _, v := range nodes {
+		if err := gh.OnNewNode(v); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 /// Retrieves the head by *recursively* looking for the highest voted block
 //   at *every* block in the path from start to head.
-func (gh *CachedLMDGhost) HeadFn() *dag.DagNode {
+func (gh *CachedLMDGhost) HeadFn() (*dag.DagNode, error) {
 	// Minor difference:
 	// Normally you would have to filter for the active validators, and get their targets.
 	// We can just iterate over the values in the common-chain.
@@ -154,18 +119,22 @@ func (gh *CachedLMDGhost) HeadFn() *dag.DagNode {
 
 	head := gh.dag.Justified
 	for {
-		if len(head.Children) == 0 {
-			return head
-		}
-		bestItem := head.Children[0]
+		var bestItem *dag.DagNode
 		var bestScore int64 = 0
 		for _, child := range head.Children {
+			// only consider viable branches
+			if !gh.dag.IsViable(child) {
+				continue
+			}
 			childVotes := gh.getVoteCount(child)
-			if childVotes > bestScore {
+			if bestItem == nil || dag.IsPreferred(child, childVotes, bestItem, bestScore) {
 				bestScore = childVotes
 				bestItem = child
 			}
 		}
+		if bestItem == nil {
+			return head, nil
+		}
 		head = bestItem
 	}
 }
@@ -173,7 +142,7 @@ func (gh *CachedLMDGhost) HeadFn() *dag.DagNode {
 func (gh *CachedLMDGhost) getVoteCount(block *dag.DagNode) int64 {
 	totalWeight := int64(0)
 	for target, weight := range gh.latestScores {
-		if anc := gh.getAncestor(target, block.Height); anc != nil && anc == target {
+		if anc := dag.GetAncestorAtSlot(target, block.Slot, &gh.ancestors, gh.cache); anc != nil && anc == block {
 			totalWeight += weight
 		}
 	}
@@ -1,22 +1,41 @@
 package proto_array
 
 import (
+	"fmt"
 	"lmd-ghost/eth2/dag"
 )
 
 const nonExistentNode = ^uint64(0)
 
+/// Variants of proto_array, see the constructors.
+type Options struct {
+
+	// Keep a best-target per node: the head is the best-target of the start node, an O(1) lookup.
+	// Without best-targets, memory and back-prop work are saved, and the head is found by walking the best-children.
+	BestTargets bool
+
+	// Prune by reslicing the arrays, and keep an index offset: indices never change, nothing but the pruned nodes is touched.
+	// Without an offset, the remaining nodes are re-indexed, which is postponed until PruneThreshold nodes can be pruned.
+	Offset bool
+
+	PruneThreshold uint64
+}
+
 type ProtoArrayLMDGhost struct {
 	dag *dag.BeaconDag
 
+	opts Options
+
 	// node best-child
 	b []uint64
 	// node values
 	w []int64
 	// node parents
 	p []uint64
-	// node best-targets
+	// node best-targets, nil without Options.BestTargets
 	t []uint64
+	// node leads to a viable head
+	v []bool
 
 	// nodes in order
 	nodes []*dag.DagNode
@@ -24,34 +43,80 @@ type ProtoArrayLMDGhost struct {
 	// root -> node index
 	indices map[*dag.DagNode]uint64
 
+	// The amount of pruned nodes: index i is located at i - offset in the arrays. Always 0 without Options.Offset.
+	offset uint64
+}
+
+/// Creates a proto_array variant with the given options.
+func NewProtoArrayWithOptions(opts Options) dag.InitForkChoice {
+	return func(d *dag.BeaconDag) dag.ForkChoice {
+		res := &ProtoArrayLMDGhost{
+			dag:     d,
+			opts:    opts,
+			indices: make(map[*dag.DagNode]uint64),
+		}
+		return res
+	}
 }
 
 func NewProtoArrayLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
-	res := &ProtoArrayLMDGhost{
-		dag:          d,
-		indices: make(map[*dag.DagNode]uint64),
+	// Small pruning does not help more than it costs to do.
+	// For implementers: tune this parameter, or trigger pruning based on this value going over a threshold.
+	return NewProtoArrayWithOptions(Options{BestTargets: true, PruneThreshold: 200})(d)
+}
+
+/// Like proto_array, but pruning is cheap: the arrays are resliced, and an offset is maintained.
+/// Indices (in the arrays, and in the lookup-map) never change, they are adjusted with the offset on every array lookup.
+func NewProtoArrayOffsetLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
+	return NewProtoArrayWithOptions(Options{BestTargets: true, Offset: true})(d)
+}
+
+/// Like proto_array, but without best-targets: the head is found by walking the best-children from the start.
+/// This saves memory and back-prop work, at the cost of a non-O(1) head lookup.
+func NewProtoArrayLazyLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
+	return NewProtoArrayWithOptions(Options{PruneThreshold: 200})(d)
+}
+
+// Returns the array position of the node, or false if it is not in the arrays (anymore).
+// Pruning is by array position: a node on another branch than the finalized node, inserted before it,
+//  is pruned here, while it may still be in the dag.
+func (gh *ProtoArrayLMDGhost) pos(n *dag.DagNode) (int64, bool) {
+	i, ok := gh.indices[n]
+	if !ok || i < gh.offset {
+		return 0, false
 	}
-	return res
+	return int64(i - gh.offset), true
 }
 
-func (gh *ProtoArrayLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
+// Returns the array position of the parent of the node at array position i, or false if there is none (anymore).
+func (gh *ProtoArrayLMDGhost) parentPos(i int64) (int64, bool) {
+	pi := gh.p[i]
+	if pi == nonExistentNode || pi < gh.offset {
+		return 0, false
+	}
+	return int64(pi - gh.offset), true
+}
+
+func (gh *ProtoArrayLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) error {
+	off := gh.offset
 	// diff values: we map changes into an array mirroring the current state arrays.
 	// These diff values can be propagated first, and then applied to the weights after.
 	// This makes it easy to recognize when a "change" cancels out somewhere:
 	//  the diff value will be 0, just like any non-change.
 	d := make([]int64, len(gh.nodes), len(gh.nodes))
-	start := int64(gh.indices[gh.dag.Finalized])
+	start, ok := gh.pos(gh.dag.Finalized)
+	if !ok {
+		return fmt.Errorf("finalized node %s is not in the proto-array", gh.dag.Finalized.Key)
+	}
 	for _, c := range changes {
-		i := gh.indices[c.Target]
-		d[i] += c.ScoreDelta
+		// changes for pruned nodes do not matter, they are not descendants of the finalized node.
+		if i, ok := gh.pos(c.Target); ok {
+			d[i] += c.ScoreDelta
+		}
 	}
 	// back-prop diff values
 	for i := int64(len(d)) - 1; i >= start; i-- {
-		pi := gh.p[i]
-		if pi == nonExistentNode {
-			continue
-		}
-		if pi != 0 {
+		if pi, ok := gh.parentPos(i); ok {
 			d[pi] += d[i]
 		}
 	}
@@ -60,22 +125,37 @@ func (gh *ProtoArrayLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
 	for i, v := range d {
 		gh.w[i] += v
 	}
+	// back-prop viability, like filter_block_tree in the spec:
+	//  a leaf is viable if it agrees with the checkpoints, any other node if one of its children is.
+	// Invalid children do not count, a node with only invalid children is a leaf.
+	anyViable := make([]bool, len(gh.nodes), len(gh.nodes))
+	anyChild := make([]bool, len(gh.nodes), len(gh.nodes))
+	for i := int64(len(d)) - 1; i >= start; i-- {
+		if anyChild[i] {
+			gh.v[i] = anyViable[i]
+		} else {
+			gh.v[i] = gh.dag.IsViableLeaf(gh.nodes[i])
+		}
+		if pi, ok := gh.parentPos(i); ok && !gh.nodes[i].Invalid {
+			anyChild[pi] = true
+			if gh.v[i] {
+				anyViable[pi] = true
+			}
+		}
+	}
 	// back-prop best-child/target updates
 	for i := int64(len(d)) - 1; i >= start; i-- {
 		// propagate best-target
-		if bi := gh.b[i]; bi != nonExistentNode {
-			gh.t[i] = gh.t[bi]
-		}
-		// if this note did not change at all, then skip it
-		if d[i] == 0 {
-			continue
+		if bi := gh.b[i]; bi != nonExistentNode && gh.t != nil {
+			gh.t[i] = gh.t[bi - off]
 		}
 		// parent of i (may not exist)
-		pi := gh.p[i]
-		if pi == nonExistentNode {
+		pi, ok := gh.parentPos(i)
+		// invalid nodes never become the best child
+		if !ok || gh.nodes[i].Invalid {
 			continue
 		}
-		ui := uint64(i)
+		ui := uint64(i) + off
 		// best child of the parent of i
 		bpi := gh.b[pi]
 		if bpi == nonExistentNode {
@@ -84,19 +164,32 @@ func (gh *ProtoArrayLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
 			continue
 		}
 		// if i is already the best, don't do any work
-		// if i changed better than the bpi, then it's worth looking at.
-		if bpi != ui && d[i] > d[bpi] {
+		// Note: even if i did not change, it still has to be compared:
+		//  the current best child may have lost weight.
+		// Every child of the parent is compared against the best, so the best child ends up to be the preferred one.
+		if bpi != ui {
 			// now look at the weights: if i is better than bpi,
 			// it becomes the best-child for its parent, and the parent is assigned the best-target of i
-			if gh.w[i] > gh.w[bpi] {
+			if gh.isPreferred(ui, bpi) {
 				gh.b[pi] = ui
 			}
 		}
 	}
+	return nil
 }
 
-func (gh *ProtoArrayLMDGhost) OnNewNode(block *dag.DagNode) {
-	i := uint64(len(gh.nodes))
+// Children leading to a viable head are preferred, then the regular tie-breaking policy applies.
+// i and j are node indices, not adjusted for the offset.
+func (gh *ProtoArrayLMDGhost) isPreferred(i uint64, j uint64) bool {
+	i, j = i - gh.offset, j - gh.offset
+	if gh.v[i] != gh.v[j] {
+		return gh.v[i]
+	}
+	return dag.IsPreferred(gh.nodes[i], gh.w[i], gh.nodes[j], gh.w[j])
+}
+
+func (gh *ProtoArrayLMDGhost) OnNewNode(block *dag.DagNode) error {
+	i := gh.offset + uint64(len(gh.nodes))
 	gh.indices[block] = i
 	// the new node does not have a best-child
 	gh.b = append(gh.b, nonExistentNode)
@@ -107,9 +200,10 @@ func (gh *ProtoArrayLMDGhost) OnNewNode(block *dag.DagNode) {
 		gh.p = append(gh.p, nonExistentNode)
 	} else {
 		// or the parent may be out of scope
-		if pi, ok := gh.indices[block.Parent]; ok {
-			gh.p = append(gh.p, pi)
+		if pi, ok := gh.pos(block.Parent); ok {
+			gh.p = append(gh.p, uint64(pi) + gh.offset)
 			// if it is the first child, it is also the best.
+			// (Otherwise it may still win a tie, or be viable: this is checked with the next weights update)
 			if gh.b[pi] == nonExistentNode {
 				gh.b[pi] = i
 			}
@@ -118,60 +212,112 @@ func (gh *ProtoArrayLMDGhost) OnNewNode(block *dag.DagNode) {
 		}
 	}
 	// new node points to itself as a best-target, since it is a leaf.
-	gh.t = append(gh.t, i)
+	if gh.opts.BestTargets {
+		gh.t = append(gh.t, i)
+	}
+	gh.v = append(gh.v, gh.dag.IsViableLeaf(block))
 	gh.nodes = append(gh.nodes, block)
+	return nil
 }
 
-func (gh *ProtoArrayLMDGhost) OnPrune() {
-	// get the index of the finalized node, and adjust to current array-space.
-	start := gh.indices[gh.dag.Finalized]
-	// Small pruning does not help more than it costs to do. Postpone pruning in such case.
-	// For implementers: tune this parameter, or trigger pruning based on this value going over a threshold.
-	if start < 200 {
-		return
+func (gh *ProtoArrayLMDGhost) OnPrune() error {
+	// the amount of nodes before the finalized node, in the current arrays.
+	start, ok := gh.pos(gh.dag.Finalized)
+	if !ok {
+		return fmt.Errorf("finalized node %s is not in the proto-array", gh.dag.Finalized.Key)
+	}
+	count := uint64(start)
+	// With an offset, no threshold is necessary: pruning is cheap, nothing but the pruned nodes is touched.
+	if !gh.opts.Offset && count < gh.opts.PruneThreshold {
+		return nil
 	}
 	// Note: the elements pruned at the start will stay in the backing array.
 	// However, since we are appending to the slice, append() may re-allocate
 	// the slice to a new backing array: eventually the pruned parts will be GC'd.
-	gh.b = gh.b[start:]
-	gh.w = gh.w[start:]
-	gh.p = gh.p[start:]
-	gh.t = gh.t[start:]
+	gh.b = gh.b[count:]
+	gh.w = gh.w[count:]
+	gh.p = gh.p[count:]
+	if gh.t != nil {
+		gh.t = gh.t[count:]
+	}
+	gh.v = gh.v[count:]
 
 	// now delete all pruned nodes from the key->index lookup-map.
-	for i := uint64(0); i < start; i++ {
-		n := gh.nodes[i]
+	for _, n := range gh.nodes[:count] {
 		delete(gh.indices, n)
 	}
-	gh.nodes = gh.nodes[start:]
+	gh.nodes = gh.nodes[count:]
+
+	if gh.opts.Offset {
+		// parents that were pruned are recognized by their index being lower than the offset.
+		gh.offset += count
+		return nil
+	}
 
 	// adjust indices back to 0
 	for i, n := range gh.nodes {
 		// best-child may not exist, i.e. does not need to be adjusted
 		if gh.b[i] != nonExistentNode {
-			gh.b[i] -= start
+			gh.b[i] -= count
+		}
+		if gh.t != nil {
+			gh.t[i] -= count
 		}
-		gh.t[i] -= start
 		// parent may not exist anymore
-		if gh.p[i] < start {
+		if gh.p[i] == nonExistentNode || gh.p[i] < count {
 			gh.p[i] = nonExistentNode
 		} else {
-			gh.p[i] -= start
+			gh.p[i] -= count
 		}
-		gh.indices[n] -= start
+		gh.indices[n] -= count
 	}
+	return nil
 }
 
-func (gh *ProtoArrayLMDGhost) HeadFn() *dag.DagNode {
-	// look up the index of the finalized node, this is our starting point
-	i := gh.indices[gh.dag.Finalized]
+func (gh *ProtoArrayLMDGhost) OnCheckpointsChange() error {
+	// nothing to do, viability is updated with the next weights update
+	return nil
+}
+
+func (gh *ProtoArrayLMDGhost) OnInvalidate(node *dag.DagNode) error {
+	// The parent of the invalid subtree may not keep it as best child:
+	//  reset it, the other children compete for it with the next weights update.
+	// Viability is updated with the next weights update as well.
+	i, ok := gh.pos(node)
+	if !ok {
+		// pruned already
+		return nil
+	}
+	if pi, ok := gh.parentPos(i); ok && gh.b[pi] == uint64(i) + gh.offset {
+		gh.b[pi] = nonExistentNode
+		if gh.t != nil {
+			gh.t[pi] = uint64(pi) + gh.offset
+		}
+	}
+	return nil
+}
+
+func (gh *ProtoArrayLMDGhost) HeadFn() (*dag.DagNode, error) {
+	// look up the index of the justified node, this is our starting point
+	i, ok := gh.pos(gh.dag.Justified)
+	if !ok {
+		return nil, fmt.Errorf("justified node %s is not in the proto-array", gh.dag.Justified.Key)
+	}
+	// if there is no viable head, then the justified node is the head.
+	if !gh.v[i] {
+		return gh.dag.Justified, nil
+	}
+	if gh.t != nil {
+		// the best-target is the head, no need to walk the best-children.
+		return gh.nodes[gh.t[i] - gh.offset], nil
+	}
+	// walk the best-children, until there is no child: this is the head.
 	for {
 		if bi := gh.b[i]; bi != nonExistentNode {
-			i = bi
+			i = int64(bi - gh.offset)
 		} else {
 			break
 		}
 	}
-	// Get the target (again, adjust index)
-	return gh.nodes[i]
+	return gh.nodes[i], nil
 }
@@ -0,0 +1,65 @@
+package proto_array
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"testing"
+)
+
+// A sibling of the finalized block, inserted before it, is pruned from the arrays but stays in the dag (its slot is later).
+// Votes for it, and invalidating it, must not touch the arrays.
+func TestPrunedSiblingOfFinalized(t *testing.T) {
+	variants := map[string]Options{
+		"offset":   {BestTargets: true, Offset: true},
+		"re-index": {BestTargets: true},
+		"lazy":     {},
+	}
+	for name, opts := range variants {
+		t.Run(name, func(t *testing.T) {
+			testPrunedSiblingOfFinalized(t, NewProtoArrayWithOptions(opts))
+		})
+	}
+}
+
+func testPrunedSiblingOfFinalized(t *testing.T, initForkChoice dag.InitForkChoice) {
+	d := dag.NewBeaconDag(initForkChoice)
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+	g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	sibling := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{2}, Slot: g.Slot + constants.EPOCH_LENGTH + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	f := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{3}, Slot: g.Slot + constants.EPOCH_LENGTH,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	for _, b := range []*block.BeaconBlock{g, sibling, f} {
+		if _, err := d.BlockIn(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH + 1, Root: f.Hash}
+	if err := d.Justify(cp); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Finalize(cp); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.Nodes[sibling.Hash]; !ok {
+		t.Fatal("expected the sibling to stay in the dag")
+	}
+	d.AttestationIn(&attestation.Attestation{BeaconBlockRoot: sibling.Hash, Attester: 1, Slot: sibling.Slot, Weight: 10})
+	head, err := d.HeadFn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != f.Hash {
+		t.Fatalf("expected the finalized block %s to be the head, got %s", f.Hash, head)
+	}
+	if err := d.InvalidateBlock(sibling.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if head, err = d.HeadFn(); err != nil || head != f.Hash {
+		t.Fatalf("expected the finalized block %s to stay the head, got %s (%v)", f.Hash, head, err)
+	}
+}
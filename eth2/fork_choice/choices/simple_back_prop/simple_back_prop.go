@@ -24,7 +24,7 @@ func NewSimpleBackPropLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
 	return res
 }
 
-func (gh *SimpleBackPropLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
+func (gh *SimpleBackPropLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) error {
 	for _, v := range changes {
 		if v.Target.Slot >= gh.dag.Finalized.Slot {
 			gh.latestScores[v.Target] += v.ScoreDelta
@@ -37,30 +37,83 @@ func (gh *SimpleBackPropLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
 			delete(gh.latestScores, k)
 		}
 	}
+	return nil
 }
 
-func (gh *SimpleBackPropLMDGhost) OnNewNode(block *dag.DagNode) {
+func (gh *SimpleBackPropLMDGhost) OnNewNode(block *dag.DagNode) error {
 	// almost free, we back-propagate all at once, when we need to.
 	if block.Slot > gh.maxKnownSlot {
 		gh.maxKnownSlot = block.Slot
 	}
+	return nil
 }
 
-func (gh *SimpleBackPropLMDGhost) OnPrune() {
+func (gh *SimpleBackPropLMDGhost) OnCheckpointsChange() error {
+	// nothing to do, branches are filtered when computing the head
+	return nil
+}
+
+func (gh *SimpleBackPropLMDGhost) OnInvalidate(node *dag.DagNode) error {
+	// nothing to do, invalid branches are not viable, and are filtered when computing the head
+	return nil
+}
+
+func (gh *SimpleBackPropLMDGhost) OnPrune() error {
 	// prune old latest_scores
 	for k := range gh.latestScores {
 		if k.Slot < gh.dag.Finalized.Slot {
 			delete(gh.latestScores, k)
 		}
 	}
+	return nil
 }
 
 type ChildScore struct {
+	Child *dag.DagNode
 	BestTarget *dag.DagNode
 	ChildScore int64
 }
 
-func (gh *SimpleBackPropLMDGhost) HeadFn() *dag.DagNode {
+/// Checks if the node is a descendant of start, remembering the results for the nodes on the way.
+func isDescendant(n *dag.DagNode, start *dag.DagNode, memo map[*dag.DagNode]bool) bool {
+	path := make([]*dag.DagNode, 0)
+	res := false
+	for {
+		if known, ok := memo[n]; ok {
+			res = known
+			break
+		}
+		if n == nil || n.Slot <= start.Slot {
+			res = n == start
+			break
+		}
+		path = append(path, n)
+		n = n.Parent
+	}
+	for _, p := range path {
+		memo[p] = res
+	}
+	return res
+}
+
+/// Children without any votes are not part of the back-propagation.
+/// If the best target has viable children, then none of them has votes, and the tie-breaking policy decides.
+func (gh *SimpleBackPropLMDGhost) descendUnweighted(target *dag.DagNode) *dag.DagNode {
+	for {
+		var best *dag.DagNode
+		for _, c := range target.Children {
+			if gh.dag.IsViable(c) && (best == nil || dag.IsPreferred(c, 0, best, 0)) {
+				best = c
+			}
+		}
+		if best == nil {
+			return target
+		}
+		target = best
+	}
+}
+
+func (gh *SimpleBackPropLMDGhost) HeadFn() (*dag.DagNode, error) {
 	start := gh.dag.Justified
 	// Keep track of weight for each block, per height
 	weightedBlocksAtHeight := make([]map[*dag.DagNode]int64, gh.maxKnownSlot + 1 - start.Slot)
@@ -69,10 +122,12 @@ func (gh *SimpleBackPropLMDGhost) HeadFn() *dag.DagNode {
 	}
 	// compute cutoff: sum all scores, and divide by 2.
 	cutOff := int64(0)
+	descendants := make(map[*dag.DagNode]bool)
 	// put all initial weights in the "DAG" (or tree, if non-justified roots would be removed)
 	for t, w := range gh.latestScores {
-		// don't include attestations for justified blocks (i.e. before/on starting point)
-		if t.Slot > start.Slot {
+		// don't include attestations for justified blocks (i.e. before/on starting point),
+		//  or blocks in other branches
+		if t.Slot > start.Slot && isDescendant(t, start, descendants) {
 			weightedBlocksAtHeight[t.Slot-start.Slot][t] = weightedBlocksAtHeight[t.Slot-start.Slot][t] + w
 			cutOff += w
 		}
@@ -85,31 +140,35 @@ func (gh *SimpleBackPropLMDGhost) HeadFn() *dag.DagNode {
 		//  while keeping track of the most-voted child.
 		for block, w := range weightedBlocksAtHeight[i] {
 			// check for cutOff, if the block weight is heavy enough, then we can just stop at this block, and use the bestChildMapping to get the final head.
-			if w > cutOff {
+			if w > cutOff && gh.dag.IsViable(block) {
 				if myBest, hasBest := bestChildMapping[block]; hasBest {
-					return myBest.BestTarget
+					return gh.descendUnweighted(myBest.BestTarget), nil
 				} else {
-					return block
+					return gh.descendUnweighted(block), nil
 				}
 			}
 			// Propagate weight of child to parent
 			weightedBlocksAtHeight[block.Parent.Slot - start.Slot][block.Parent] = weightedBlocksAtHeight[block.Parent.Slot - start.Slot][block.Parent] + w
 			// keep track of the best child for this parent block
+			// (only viable branches can be chosen)
+			if !gh.dag.IsViable(block) {
+				continue
+			}
 			mapping, initialized := bestChildMapping[block.Parent]
-			if !initialized || w > mapping.ChildScore {
+			if !initialized || dag.IsPreferred(block, w, mapping.Child, mapping.ChildScore) {
 				if myBest, hasBest := bestChildMapping[block]; hasBest {
 					// inherit the best-target if there is one
-					bestChildMapping[block.Parent] = ChildScore{BestTarget: myBest.BestTarget, ChildScore: w}
+					bestChildMapping[block.Parent] = ChildScore{Child: block, BestTarget: myBest.BestTarget, ChildScore: w}
 				} else {
 					// otherwise just put this node as the best target, if it has no entry in the bestChildMapping, then the node has no children
-					bestChildMapping[block.Parent] = ChildScore{BestTarget: block, ChildScore: w}
+					bestChildMapping[block.Parent] = ChildScore{Child: block, BestTarget: block, ChildScore: w}
 				}
 			}
 		}
 	}
 	if myBest, hasBest := bestChildMapping[start]; hasBest {
-		return myBest.BestTarget
+		return gh.descendUnweighted(myBest.BestTarget), nil
 	} else {
-		return gh.dag.Justified
+		return gh.descendUnweighted(gh.dag.Justified), nil
 	}
 }
@@ -20,7 +20,7 @@ func NewSpecLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
 	return res
 }
 
-func (gh *SpecLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
+func (gh *SpecLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) error {
 	for _, v := range changes {
 		if v.Target.Slot >= gh.dag.Finalized.Slot {
 			gh.latestScores[v.Target] += v.ScoreDelta
@@ -33,24 +33,37 @@ func (gh *SpecLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
 			delete(gh.latestScores, k)
 		}
 	}
+	return nil
 }
 
-func (gh *SpecLMDGhost) OnNewNode(node *dag.DagNode) {
+func (gh *SpecLMDGhost) OnNewNode(node *dag.DagNode) error {
 	// free, at cost of head-function
+	return nil
 }
 
-func (gh *SpecLMDGhost) OnPrune() {
+func (gh *SpecLMDGhost) OnCheckpointsChange() error {
+	// nothing to do, branches are filtered when computing the head
+	return nil
+}
+
+func (gh *SpecLMDGhost) OnInvalidate(node *dag.DagNode) error {
+	// nothing to do, invalid branches are not viable, and are filtered when computing the head
+	return nil
+}
+
+func (gh *SpecLMDGhost) OnPrune() error {
 	// prune old latest_scores
 	for k := range gh.latestScores {
 		if k.Slot < gh.dag.Finalized.Slot {
 			delete(gh.latestScores, k)
 		}
 	}
+	return nil
 }
 
 /// Retrieves the head by *recursively* looking for the highest voted block
 //   at *every* block in the path from start to head.
-func (gh *SpecLMDGhost) HeadFn() *dag.DagNode {
+func (gh *SpecLMDGhost) HeadFn() (*dag.DagNode, error) {
 	// Minor difference:
 	// Normally you would have to filter for the active validators, and get their targets.
 	// We can just iterate over the values in the common-chain.
@@ -59,18 +72,22 @@ func (gh *SpecLMDGhost) HeadFn() *dag.DagNode {
 
 	head := gh.dag.Justified
 	for {
-		if len(head.Children) == 0 {
-			return head
-		}
-		bestItem := head.Children[0]
+		var bestItem *dag.DagNode
 		var bestScore int64 = 0
 		for _, child := range head.Children {
+			// only consider viable branches
+			if !gh.dag.IsViable(child) {
+				continue
+			}
 			childVotes := gh.getVoteCount(child)
-			if childVotes > bestScore {
+			if bestItem == nil || dag.IsPreferred(child, childVotes, bestItem, bestScore) {
 				bestScore = childVotes
 				bestItem = child
 			}
 		}
+		if bestItem == nil {
+			return head, nil
+		}
 		head = bestItem
 	}
 }
@@ -78,7 +95,7 @@ func (gh *SpecLMDGhost) HeadFn() *dag.DagNode {
 func (gh *SpecLMDGhost) getVoteCount(block *dag.DagNode) int64 {
 	totalWeight := int64(0)
 	for target, weight := range gh.latestScores {
-		if anc := gh.getAncestor(target, block.Slot); anc != nil && anc == target {
+		if anc := gh.getAncestor(target, block.Slot); anc != nil && anc == block {
 			totalWeight += weight
 		}
 	}
@@ -87,7 +104,10 @@ func (gh *SpecLMDGhost) getVoteCount(block *dag.DagNode) int64 {
 
 /// Gets the ancestor of `node` at `slot`
 func (gh *SpecLMDGhost) getAncestor(block *dag.DagNode, slot uint64) *dag.DagNode {
-	if block.Slot == slot {
+	if block == nil {
+		// the branch was pruned before reaching the slot
+		return nil
+	} else if block.Slot == slot {
 		return block
 	} else if block.Slot < slot {
 		return nil
@@ -0,0 +1,40 @@
+package spec
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"testing"
+)
+
+// The votes for descendants of a child count for the child, not only the votes for the child itself.
+func TestVotesForDescendantsCount(t *testing.T) {
+	d := dag.NewBeaconDag(NewSpecLMDGhost)
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+	g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	// a has the heavier subtree, but no direct votes. b has the higher hash, and one direct vote.
+	a := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{2}, Slot: g.Slot + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	a2 := &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{3}, Slot: g.Slot + 2,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	b := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{4}, Slot: g.Slot + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	for _, bl := range []*block.BeaconBlock{g, a, a2, b} {
+		if _, err := d.BlockIn(bl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.AttestationIn(&attestation.Attestation{BeaconBlockRoot: a2.Hash, Attester: 1, Slot: a2.Slot, Weight: 2})
+	d.AttestationIn(&attestation.Attestation{BeaconBlockRoot: b.Hash, Attester: 2, Slot: b.Slot, Weight: 1})
+
+	head, err := d.HeadFn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != a2.Hash {
+		t.Fatalf("expected head %s, got %s", a2.Hash, head)
+	}
+}
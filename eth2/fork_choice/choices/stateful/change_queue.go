@@ -0,0 +1,71 @@
+package stateful
+
+import (
+	"container/heap"
+	"lmd-ghost/eth2/dag"
+)
+
+// A change of a node that has yet to be propagated.
+type pendingChange struct {
+	node *dag.DagNode
+	// the sum of all weight changes for the node
+	delta int64
+	// the best-target of the node before any of the changes
+	prevTarget *dag.DagNode
+}
+
+// Changes to propagate, highest slot first: children are always processed before their parents.
+// Changes for the same node are merged.
+type changeQueue struct {
+	changes []*pendingChange
+	byNode map[*dag.DagNode]*pendingChange
+}
+
+func newChangeQueue() *changeQueue {
+	return &changeQueue{
+		changes: make([]*pendingChange, 0),
+		byNode: make(map[*dag.DagNode]*pendingChange),
+	}
+}
+
+// Queues a weight change for the node, or merges it with the change that is already queued for it.
+func (q *changeQueue) add(n *dag.DagNode, delta int64) {
+	if c, ok := q.byNode[n]; ok {
+		c.delta += delta
+		return
+	}
+	c := &pendingChange{node: n, delta: delta, prevTarget: n.BestTarget}
+	q.byNode[n] = c
+	heap.Push(q, c)
+}
+
+func (q *changeQueue) pop() *pendingChange {
+	c := heap.Pop(q).(*pendingChange)
+	delete(q.byNode, c.node)
+	return c
+}
+
+// heap.Interface, not to be used directly.
+
+func (q *changeQueue) Len() int {
+	return len(q.changes)
+}
+
+func (q *changeQueue) Less(i, j int) bool {
+	return q.changes[i].node.Slot > q.changes[j].node.Slot
+}
+
+func (q *changeQueue) Swap(i, j int) {
+	q.changes[i], q.changes[j] = q.changes[j], q.changes[i]
+}
+
+func (q *changeQueue) Push(x interface{}) {
+	q.changes = append(q.changes, x.(*pendingChange))
+}
+
+func (q *changeQueue) Pop() interface{} {
+	last := len(q.changes) - 1
+	c := q.changes[last]
+	q.changes = q.changes[:last]
+	return c
+}
@@ -1,122 +1,221 @@
 package stateful
 
 import (
+	"fmt"
 	"lmd-ghost/eth2/dag"
+	"sort"
 )
 
-func onAddWeight(n *dag.DagNode) {
+/// A simple take on using a DAG for the fork-choice.
+/// Stores entries in DAG, and propagates target votes at the insertion time.
+type StatefulLMDGhost struct {
 
-	// if we're not the best child of the parent, than we have a chance to become it.
-	if n.Parent != nil && n.IndexAsChild != 0 {
-		if oldBest := n.Parent.Children[0]; n.Weight > oldBest.Weight {
-			// the best has been overthrown, now swap it out
-			n.Parent.Children[0] = n
-			n.Parent.Children[n.IndexAsChild] = oldBest
-			oldBest.IndexAsChild = n.IndexAsChild
-			n.IndexAsChild = 0
+	dag *dag.BeaconDag
 
-			// Update the target of the parent, it inherits it from this node
-			n.Parent.BestTarget = n.BestTarget
-		}
+}
+
+func NewStatefulLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
+	res := &StatefulLMDGhost{
+		dag:          d,
 	}
+	return res
 }
 
-func onRemoveWeight(n *dag.DagNode) {
-	if n.Weight < 0 {
-		panic("Error: removed too much weight! Weight of a node cannot be negative!")
+// Branches leading to a viable head are preferred, then the regular tie-breaking policy applies.
+// The best-target is the best leaf of a branch: if it is not viable, then no leaf in the branch is.
+// Invalid branches always come last.
+func (gh *StatefulLMDGhost) isPreferred(a *dag.DagNode, b *dag.DagNode) bool {
+	if a.Invalid != b.Invalid {
+		return b.Invalid
 	}
+	aViable := gh.dag.IsViableLeaf(a.BestTarget)
+	bViable := gh.dag.IsViableLeaf(b.BestTarget)
+	if aViable != bViable {
+		return aViable
+	}
+	return dag.IsPreferred(a, a.Weight, b, b.Weight)
+}
 
-	// if we're the best child of the parent, than we have a chance to lose our position to the second best.
-	if n.Parent != nil && n.IndexAsChild == 0 && len(n.Parent.Children) > 1 {
-		// TODO: with some sorting it may be faster to keep track of the 2nd best child
-		newBest := n
-		for i := 1; i < len(n.Parent.Children); i++ {
-			c := n.Parent.Children[i]
-			if c.Weight > newBest.Weight {
-				newBest = c
-			}
-		}
-		// check if we actually have to update the new-best
-		if newBest != n {
-			// we have been overthrown, now swap in the new best
-			n.Parent.Children[0] = newBest
-			n.Parent.Children[newBest.IndexAsChild] = n
-			n.IndexAsChild = newBest.IndexAsChild
-			newBest.IndexAsChild = 0
-
-			// Update the target of the parent, it inherits it from the new-best
-			n.Parent.BestTarget = newBest.BestTarget
+// The children of a node are kept as a binary heap, ordered by isPreferred:
+//  the best child is always Children[0], and IndexAsChild is the position of a node in the heap.
+// A child that gets better or worse moves up or down in O(log k), for k children, no linear rescans.
+
+func swapChildren(p *dag.DagNode, i uint32, j uint32) {
+	p.Children[i], p.Children[j] = p.Children[j], p.Children[i]
+	p.Children[i].IndexAsChild = i
+	p.Children[j].IndexAsChild = j
+}
+
+// Moves n up between its siblings, while it is preferred over its parent in the heap.
+func (gh *StatefulLMDGhost) siftUp(n *dag.DagNode) {
+	p := n.Parent
+	for n.IndexAsChild > 0 {
+		up := p.Children[(n.IndexAsChild - 1) / 2]
+		if !gh.isPreferred(n, up) {
+			break
 		}
+		swapChildren(p, n.IndexAsChild, up.IndexAsChild)
 	}
 }
 
-/// A simple take on using a DAG for the fork-choice.
-/// Stores entries in DAG, and propagates target votes at the insertion time.
-type StatefulLMDGhost struct {
+// Moves n down between its siblings, while one of its children in the heap is preferred over it.
+func (gh *StatefulLMDGhost) siftDown(n *dag.DagNode) {
+	p := n.Parent
+	count := uint32(len(p.Children))
+	for {
+		best := n
+		if l := 2 * n.IndexAsChild + 1; l < count && gh.isPreferred(p.Children[l], best) {
+			best = p.Children[l]
+		}
+		if r := 2 * n.IndexAsChild + 2; r < count && gh.isPreferred(p.Children[r], best) {
+			best = p.Children[r]
+		}
+		if best == n {
+			break
+		}
+		swapChildren(p, n.IndexAsChild, best.IndexAsChild)
+	}
+}
 
-	dag *dag.BeaconDag
+// The best-target of n is the best-target of its best child.
+// If there are no (valid) children, n is the best-target itself.
+func updateBestTarget(n *dag.DagNode) {
+	if len(n.Children) == 0 || n.Children[0].Invalid {
+		n.BestTarget = n
+	} else {
+		n.BestTarget = n.Children[0].BestTarget
+	}
+}
 
+// Orders the children of n from scratch, e.g. after the viability of the branches changed.
+func (gh *StatefulLMDGhost) heapifyChildren(n *dag.DagNode) {
+	for i := len(n.Children) / 2 - 1; i >= 0; i-- {
+		gh.siftDown(n.Children[i])
+	}
 }
 
-func NewStatefulLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
-	res := &StatefulLMDGhost{
-		dag:          d,
+// Checks the position of n between its siblings, after its weight and/or best-target changed.
+// A node can get better (more weight, or a viable target) and worse at the same time.
+// Afterwards, the parent inherits the best-target of its best child, which may have changed.
+func (gh *StatefulLMDGhost) onChange(n *dag.DagNode, better bool, worse bool) {
+	if n.Parent == nil {
+		return
 	}
-	return res
+	if better {
+		gh.siftUp(n)
+	}
+	if worse {
+		gh.siftDown(n)
+	}
+	updateBestTarget(n.Parent)
 }
 
-func (gh *StatefulLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
-	// TODO: implement dissolving between changes.
-	// TODO: maybe implement cut-off for propagation, i.e. just propagate weight changes,
-	//  no need to check for new best-target after cut-off.
+// Propagates all queued changes (weight deltas and/or best-targets) towards the root.
+// Nodes are processed children before parents, so changes from different branches are merged
+//  at their common ancestors before they are propagated further: "-w" and "+w" dissolve there.
+// A node is cut-off when its weight and best-target did not change after merging:
+//  nothing can change for its parent either, if no other change was queued for the parent.
+func (gh *StatefulLMDGhost) propagate(q *changeQueue) error {
+	for q.Len() > 0 {
+		c := q.pop()
+		n := c.node
+		if c.delta == 0 && n.BestTarget == c.prevTarget {
+			// dissolved or cut-off, nothing to propagate
+			continue
+		}
+		n.Weight += c.delta
+		if n.Weight < 0 {
+			return fmt.Errorf("removed too much weight, weight of node %s is negative: %d", n.Key, n.Weight)
+		}
+		p := n.Parent
+		if p == nil {
+			continue
+		}
+		wasViable := gh.dag.IsViableLeaf(c.prevTarget)
+		isViable := gh.dag.IsViableLeaf(n.BestTarget)
+		better := c.delta > 0 || (!wasViable && isViable)
+		worse := c.delta < 0 || (wasViable && !isViable)
+		// queue the parent before changing it, to remember its previous best-target
+		q.add(p, c.delta)
+		gh.onChange(n, better, worse)
+	}
+	return nil
+}
 
-	// back-propagation
+func (gh *StatefulLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) error {
+	// back-propagation, all changes at once, so they can dissolve
+	q := newChangeQueue()
 	for _, v := range changes {
-		n := v.Target
-		// Propagate down the tree
-		for n != nil {
-			n.Weight += v.ScoreDelta
-			if v.ScoreDelta < 0 {
-				onRemoveWeight(n)
-			} else {
-				onAddWeight(n)
-			}
-			n = n.Parent
-		}
+		q.add(v.Target, v.ScoreDelta)
 	}
+	return gh.propagate(q)
 }
 
-func (gh *StatefulLMDGhost) OnNewNode(node *dag.DagNode) {
+func (gh *StatefulLMDGhost) OnNewNode(node *dag.DagNode) error {
 	// best end-target is the block itself
 	node.BestTarget = node
-	if node.Parent != nil && len(node.Parent.Children) == 1 {
-		// If this is the only/first node that is added,
-		//  then it does not need attestations, it will just be the new target.
-
-		// propagate the new best-target up, as far as necessary
-		p := node.Parent
-		c := node
-		for p != nil {
-			if c.IndexAsChild == 0 {
-				p.BestTarget = node.BestTarget
-				c = p
-				p = p.Parent
-			} else {
-				// stop propagating when the child is not the best child of the parent
-				break
-			}
-		}
+	// If this is the only/first node that is added,
+	//  then it does not need attestations, it will just be the new target.
+	// Otherwise it may still win a tie with the current best child, which has no votes either.
+	// Propagate the new best-target up, as far as necessary.
+	if node.Parent != nil {
+		q := newChangeQueue()
+		q.add(node.Parent, 0)
+		gh.onChange(node, true, false)
+		return gh.propagate(q)
 	}
+	return nil
 }
 
-func (gh *StatefulLMDGhost) OnPrune() {
+func (gh *StatefulLMDGhost) OnPrune() error {
 	// nothing to do when the dag is pruned, state is pruned with it
+	return nil
 }
 
-func (gh *StatefulLMDGhost) HeadFn() *dag.DagNode {
+func (gh *StatefulLMDGhost) OnCheckpointsChange() error {
+	// The viability of any branch may have changed: recompute all best-children and targets.
+	nodes := make([]*dag.DagNode, 0, len(gh.dag.Nodes))
+	for _, n := range gh.dag.Nodes {
+		nodes = append(nodes, n)
+	}
+	gh.rebuild(nodes)
+	return nil
+}
+
+func (gh *StatefulLMDGhost) OnInvalidate(node *dag.DagNode) error {
+	// The subtree is not viable anymore, and its position between its siblings changed:
+	//  recompute the best-children and targets of the subtree, and of all the ancestors.
+	nodes := []*dag.DagNode{node}
+	for i := 0; i < len(nodes); i++ {
+		nodes = append(nodes, nodes[i].Children...)
+	}
+	for p := node.Parent; p != nil; p = p.Parent {
+		nodes = append(nodes, p)
+	}
+	gh.rebuild(nodes)
+	return nil
+}
+
+// Recomputes the best-children and targets of the given nodes, from scratch.
+func (gh *StatefulLMDGhost) rebuild(nodes []*dag.DagNode) {
+	// children before parents
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Slot > nodes[j].Slot
+	})
+	for _, n := range nodes {
+		gh.heapifyChildren(n)
+		updateBestTarget(n)
+	}
+}
+
+func (gh *StatefulLMDGhost) HeadFn() (*dag.DagNode, error) {
 	// All the work has already been done, just pick the best-target of the root node.
 	// *Bonus*: And this works for *every* node in the graph!
 	// Changing the root is costless
 	// (If you prune away old nodes it still costs something, but this also needs to be done for other algos)
-	return gh.dag.Justified.BestTarget
+	// If the best-target is not viable, then there is no viable branch, and the justified node is the head.
+	if head := gh.dag.Justified.BestTarget; gh.dag.IsViableLeaf(head) {
+		return head, nil
+	}
+	return gh.dag.Justified, nil
 }
@@ -0,0 +1,199 @@
+package stateful
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"lmd-ghost/eth2/fork_choice/choices/spec"
+	"lmd-ghost/eth2/fork_choice/cross_check"
+	"math/rand"
+	"testing"
+)
+
+// A root with width children, all weighted equally.
+func wideFork(b *testing.B, width int) (*StatefulLMDGhost, *dag.DagNode) {
+	d := dag.NewBeaconDag(NewStatefulLMDGhost)
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+	blocks := []*block.BeaconBlock{{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < width; i++ {
+		k := common.Hash256{}
+		rng.Read(k[:])
+		blocks = append(blocks, &block.BeaconBlock{ParentHash: genesisCp.Root, Hash: k, Slot: constants.GENESIS_SLOT + 1,
+			JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp})
+	}
+	for _, bl := range blocks {
+		if _, err := d.BlockIn(bl); err != nil {
+			b.Fatal(err)
+		}
+	}
+	root := d.Nodes[genesisCp.Root]
+	changes := make([]dag.ScoreChange, 0, width)
+	for _, c := range root.Children {
+		changes = append(changes, dag.ScoreChange{Target: c, ScoreDelta: 1000})
+	}
+	gh := d.ForkChoice.(*StatefulLMDGhost)
+	if err := gh.ApplyScoreChanges(changes); err != nil {
+		b.Fatal(err)
+	}
+	return gh, root
+}
+
+// The bookkeeping before the children were kept as a heap:
+//  only the best child is tracked, and all siblings are rescanned when it gets worse.
+func (gh *StatefulLMDGhost) rescanOnChange(n *dag.DagNode, better bool, worse bool) {
+	p := n.Parent
+	best := p.Children[0]
+	if n.IndexAsChild == 0 && worse {
+		for _, c := range p.Children[1:] {
+			if gh.isPreferred(c, best) {
+				best = c
+			}
+		}
+	} else if n.IndexAsChild != 0 && better && gh.isPreferred(n, best) {
+		best = n
+	}
+	if best != p.Children[0] {
+		swapChildren(p, 0, best.IndexAsChild)
+	}
+	updateBestTarget(p)
+}
+
+// Wide fork (5000 siblings): weight moves away from the best child, to a random sibling.
+func BenchmarkStatefulWideFork(b *testing.B) {
+	const width = 5000
+	run := func(b *testing.B, onChange func(gh *StatefulLMDGhost, n *dag.DagNode, better bool, worse bool)) {
+		gh, root := wideFork(b, width)
+		rng := rand.New(rand.NewSource(2))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			best := root.Children[0]
+			best.Weight -= 10
+			onChange(gh, best, false, true)
+			other := root.Children[rng.Intn(width)]
+			other.Weight += 10
+			onChange(gh, other, true, false)
+		}
+	}
+	b.Run("heap", func(b *testing.B) {
+		run(b, (*StatefulLMDGhost).onChange)
+	})
+	b.Run("rescan", func(b *testing.B) {
+		run(b, (*StatefulLMDGhost).rescanOnChange)
+	})
+}
+
+// The same events for the stateful rule and the spec rule: the heads must agree after every batch of changes.
+func crossCheckWithSpec() *cross_check.CrossCheck {
+	return cross_check.NewCrossCheck(map[string]dag.InitForkChoice{
+		"spec": spec.NewSpecLMDGhost,
+		"stateful": NewStatefulLMDGhost,
+	})
+}
+
+func checkHead(t *testing.T, cc *cross_check.CrossCheck) common.Hash256 {
+	t.Helper()
+	head, err := cc.HeadFn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the weights the stateful rule keeps must match the independently computed weights
+	d := cc.Dags["stateful"]
+	for _, n := range d.Nodes {
+		if w := d.GetWeight(n); n.Weight != w {
+			t.Fatalf("node %s has weight %d, expected %d", n.Key, n.Weight, w)
+		}
+	}
+	return head
+}
+
+// g <- x <- a <- a2, x <- b <- b2, and g <- y: votes move from a2 to b2 in one batch.
+// The changes dissolve at x, its weight does not change, and propagation is cut-off there.
+func TestDissolveMatchesSpec(t *testing.T) {
+	cc := crossCheckWithSpec()
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+	g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	blocks := []*block.BeaconBlock{g}
+	child := func(parent *block.BeaconBlock, h uint8) *block.BeaconBlock {
+		b := &block.BeaconBlock{ParentHash: parent.Hash, Hash: common.Hash256{h}, Slot: parent.Slot + 1,
+			JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+		blocks = append(blocks, b)
+		return b
+	}
+	x := child(g, 2)
+	a := child(x, 3)
+	a2 := child(a, 4)
+	b := child(x, 5)
+	b2 := child(b, 6)
+	y := child(g, 7)
+	for _, bl := range blocks {
+		if err := cc.BlockIn(bl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vote := func(id common.ValidatorID, target *block.BeaconBlock, slot uint64) {
+		cc.AttestationIn(&attestation.Attestation{BeaconBlockRoot: target.Hash, Attester: id, Slot: slot, Weight: 10})
+	}
+	for id := common.ValidatorID(0); id < 5; id++ {
+		vote(id, a2, a2.Slot)
+	}
+	vote(5, y, y.Slot)
+	if head := checkHead(t, cc); head != a2.Hash {
+		t.Fatalf("expected head %s, got %s", a2.Hash, head)
+	}
+	xNode := cc.Dags["stateful"].Nodes[x.Hash]
+	xWeight := xNode.Weight
+
+	for id := common.ValidatorID(0); id < 3; id++ {
+		vote(id, b2, b2.Slot + 1)
+	}
+	if head := checkHead(t, cc); head != b2.Hash {
+		t.Fatalf("expected head %s, got %s", b2.Hash, head)
+	}
+	if xNode.Weight != xWeight {
+		t.Fatalf("expected the weight of the common ancestor to stay %d, got %d", xWeight, xNode.Weight)
+	}
+}
+
+// Random trees and random batches of vote changes: votes move within and between branches,
+//  dissolving at common ancestors, or are cut-off where the best child does not change.
+func TestRandomChangesMatchSpec(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	cc := crossCheckWithSpec()
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+	blocks := []*block.BeaconBlock{{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}}
+	if err := cc.BlockIn(blocks[0]); err != nil {
+		t.Fatal(err)
+	}
+	const validators = 40
+	slot := constants.GENESIS_SLOT
+	for round := 0; round < 100; round++ {
+		// a few new blocks, on recent blocks
+		for i := 0; i < 3; i++ {
+			parent := blocks[len(blocks) - 1 - rng.Intn(len(blocks)) / 2]
+			b := &block.BeaconBlock{ParentHash: parent.Hash, Slot: parent.Slot + 1 + uint64(rng.Intn(2)),
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			rng.Read(b.Hash[:])
+			if b.Slot > slot {
+				slot = b.Slot
+			}
+			if err := cc.BlockIn(b); err != nil {
+				t.Fatal(err)
+			}
+			blocks = append(blocks, b)
+		}
+		// a batch of votes, synced at once
+		slot++
+		for i := 0; i < 10; i++ {
+			target := blocks[rng.Intn(len(blocks))]
+			cc.AttestationIn(&attestation.Attestation{BeaconBlockRoot: target.Hash, Attester: common.ValidatorID(rng.Intn(validators)),
+				Slot: slot, Weight: uint64(1 + rng.Intn(3))})
+		}
+		checkHead(t, cc)
+	}
+}
@@ -1,6 +1,7 @@
 package vitalik
 
 import (
+	"fmt"
 	"lmd-ghost/eth2/dag"
 )
 
@@ -32,6 +33,9 @@ type VitaliksOptimizedLMDGhost struct {
 
 	cache map[CacheKey]*dag.DagNode
 
+	// block-ref + slot -> ancestor (at the slot, or the latest before it)
+	slotCache map[dag.AncestorCacheKey]*dag.DagNode
+
 	// slot -> block-ref -> ancestor
 	ancestors [16]map[*dag.DagNode]*dag.DagNode
 
@@ -43,6 +47,7 @@ func NewVitaliksOptimizedLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
 		dag: d,
 		latestScores: make(map[*dag.DagNode]int64),
 		cache: make(map[CacheKey]*dag.DagNode),
+		slotCache: make(map[dag.AncestorCacheKey]*dag.DagNode),
 		ancestors: [16]map[*dag.DagNode]*dag.DagNode{},
 		maxKnownHeight: 0,
 	}
@@ -52,7 +57,7 @@ func NewVitaliksOptimizedLMDGhost(d *dag.BeaconDag) dag.ForkChoice {
 	return res
 }
 
-func (gh *VitaliksOptimizedLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) {
+func (gh *VitaliksOptimizedLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) error {
 	for _, v := range changes {
 		if v.Target.Slot >= gh.dag.Finalized.Slot {
 			gh.latestScores[v.Target] += v.ScoreDelta
@@ -65,13 +70,15 @@ func (gh *VitaliksOptimizedLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange
 			delete(gh.latestScores, k)
 		}
 	}
+	return nil
 }
 
-func (gh *VitaliksOptimizedLMDGhost) OnNewNode(block *dag.DagNode) {
-	startHeight := gh.dag.Finalized.Height
+func (gh *VitaliksOptimizedLMDGhost) OnNewNode(block *dag.DagNode) error {
 	// update the ancestor data (used for logarithmic lookup)
+	// Note: heights are absolute, not relative to the finalized node like before,
+	//  so the ancestor data of remaining nodes does not change when the DAG is pruned.
 	for i := uint8(0); i < 16; i++ {
-		if (block.Height - startHeight) % (1 << i) == 0 {
+		if block.Height % (1 << i) == 0 {
 			gh.ancestors[i][block] = block.Parent
 		} else {
 			gh.ancestors[i][block] = gh.ancestors[i][block.Parent]
@@ -82,17 +89,18 @@ func (gh *VitaliksOptimizedLMDGhost) OnNewNode(block *dag.DagNode) {
 	if block.Height > gh.maxKnownHeight {
 		gh.maxKnownHeight = block.Height
 	}
+	return nil
 }
 
 /// Similar to the spec get_ancestor,
 /// but using height instead of slot numbers to enable skipping ahead logarithmically, and with caching.
-func (gh *VitaliksOptimizedLMDGhost) getAncestor(block *dag.DagNode, height uint64) *dag.DagNode {
+func (gh *VitaliksOptimizedLMDGhost) getAncestor(block *dag.DagNode, height uint64) (*dag.DagNode, error) {
 
 	if height >= block.Height {
 		if height > block.Height {
-			return nil
+			return nil, nil
 		} else {
-			return block
+			return block, nil
 		}
 	}
 
@@ -107,58 +115,75 @@ func (gh *VitaliksOptimizedLMDGhost) getAncestor(block *dag.DagNode, height uint
 	// check cache
 	if res, ok := gh.cache[cacheKey]; ok {
 		// hit!
-		return res
-	}
-
-	if x := gh.ancestors[logz[block.Height - height - 1]][block]; x == nil {
-		panic("Ancestors data is invalid")
+		return res, nil
 	}
 
 	// this will be the output
 	// skip ahead logarithmically to find the ancestor, and dive in recursively
 	skipBlock := gh.ancestors[logz[block.Height - height - 1]][block]
-	o := gh.getAncestor(skipBlock, height)
-	if o == nil {
-		return nil
+	if skipBlock == nil {
+		// the branch was disconnected from the justified part of the DAG by pruning, there is no ancestor.
+		return nil, nil
+	}
+	o, err := gh.getAncestor(skipBlock, height)
+	if o == nil || err != nil {
+		return nil, err
 	}
 
 	if o.Height != height {
-		panic("Found ancestor is at wrong height")
+		return nil, fmt.Errorf("found ancestor %s of %s at height %d, expected height %d", o.Key, block.Key, o.Height, height)
 	}
 
 	// cache this, so we never have to handle beyond this point again.
 	gh.cache[cacheKey] = o
 
-	return o
+	return o, nil
 }
 
-
 func (gh *VitaliksOptimizedLMDGhost) getPowerOf2Below(x uint64) uint64 {
 	// simply logz it, and 2^e this, to get the closes power of 2
 	return 1 << logz[x]
 }
 
-func (gh *VitaliksOptimizedLMDGhost) getClearWinner(latestVotes map[*dag.DagNode]int64, height uint64) *dag.DagNode {
-	// get the total vote count at this height
+/// Finds a block at the given height that has the strict majority of the votes below the current head.
+/// Such a block is preferred at every height between the head and itself, whatever the tie-breaking.
+func (gh *VitaliksOptimizedLMDGhost) getClearWinner(latestVotes map[*dag.DagNode]int64, head *dag.DagNode, height uint64) (*dag.DagNode, error) {
+	// get the total vote count below the head (latest votes only contains votes for the head and its descendants)
 	totalVoteCount := int64(0)
 	// map of vote-counts for every hash at this height
 	atHeight := make(map[*dag.DagNode]int64)
 	for t, v := range latestVotes {
-		anc := gh.getAncestor(t, height)
+		if t.Height <= head.Height {
+			continue
+		}
+		totalVoteCount += v
+		anc, err := gh.getAncestor(t, height)
+		if err != nil {
+			return nil, err
+		}
 		if anc != nil {
 			atHeight[anc] = atHeight[anc] + v
-			totalVoteCount += v
 		}
 	}
 	for k, v := range atHeight {
-		if v >= totalVoteCount / 2 {
-			return k
+		if v > totalVoteCount / 2 {
+			return k, nil
 		}
 	}
+	return nil, nil
+}
+
+func (gh *VitaliksOptimizedLMDGhost) OnCheckpointsChange() error {
+	// nothing to do, branches are filtered when computing the head
 	return nil
 }
 
-func (gh *VitaliksOptimizedLMDGhost) OnPrune() {
+func (gh *VitaliksOptimizedLMDGhost) OnInvalidate(node *dag.DagNode) error {
+	// nothing to do, invalid branches are not viable, and are filtered when computing the head
+	return nil
+}
+
+func (gh *VitaliksOptimizedLMDGhost) OnPrune() error {
 	minSlot := gh.dag.Finalized.Slot
 	// prune old latest_scores
 	for k := range gh.latestScores {
@@ -166,33 +191,34 @@ func (gh *VitaliksOptimizedLMDGhost) OnPrune() {
 			delete(gh.latestScores, k)
 		}
 	}
-	// prune cache (based on slot), and re-init ancestor data for non-pruned data
+	// prune cache (based on slot)
 	for k, v := range gh.cache {
 		if v.Slot < minSlot {
 			// deletion during iteration here is safe in Go
 			delete(gh.cache, k)
 		}
 	}
-	// TODO: pruning ancestor data is a logistic nightmare.
-	// prune away old ancestor data
-	//for _, ancMap := range gh.ancestors {
-	//	for k, v := range ancMap {
-	//		if v == nil {
-	//			if k.Slot < minSlot {
-	//				delete(ancMap, k)
-	//			}
-	//		} else if v.Slot < minSlot {
-	//			delete(ancMap, k)
-	//		}
-	//	}
-	//}
-	// now update all ancestor data.
-	for _, v := range gh.dag.Nodes {
-		gh.OnNewNode(v)
+	for k, v := range gh.slotCache {
+		if v.Slot < minSlot {
+			delete(gh.slotCache, k)
+		}
+	}
+	// prune away old ancestor data.
+	// Skips to pruned nodes are removed: these are only necessary to look up ancestors older than the finalized node,
+	//  or for branches that are disconnected by the pruning, which have no ancestors in the DAG anymore.
+	for _, ancMap := range gh.ancestors {
+		for k, v := range ancMap {
+			if k.Slot < minSlot {
+				delete(ancMap, k)
+			} else if v != nil && v.Slot < minSlot {
+				ancMap[k] = nil
+			}
+		}
 	}
+	return nil
 }
 
-func (gh *VitaliksOptimizedLMDGhost) HeadFn() *dag.DagNode {
+func (gh *VitaliksOptimizedLMDGhost) HeadFn() (*dag.DagNode, error) {
 	// Trick: At first we consider all targets (latest attestations), but later we start forgetting attestations
 	//  that do not affect the remaining path-finding from start to head.
 	// Modification from original: we keep track of total attestation-score per target block, instead of all attestations.
@@ -204,17 +230,38 @@ func (gh *VitaliksOptimizedLMDGhost) HeadFn() *dag.DagNode {
 	}
 	head := gh.dag.Justified
 	for {
-		// short var "c": head.Children
-		if len(head.Children) == 0 {
-			return head
+		// Optimize the graph by removing votes that do not belong to the current head.
+		// (like the spec, by slot. Heights are only used below, for the majority trick, which needs layers without gaps)
+		deletes := make([]*dag.DagNode, 0)
+		for k := range latestVotes {
+			if anc := dag.GetAncestorAtSlot(k, head.Slot, &gh.ancestors, gh.slotCache); anc == nil || anc != head {
+				deletes = append(deletes, k)
+			}
+		}
+		for _, k := range deletes {
+			delete(latestVotes, k)
+		}
+
+		// only consider viable branches
+		viableChildren := make([]*dag.DagNode, 0, len(head.Children))
+		for _, child := range head.Children {
+			if gh.dag.IsViable(child) {
+				viableChildren = append(viableChildren, child)
+			}
+		}
+		if len(viableChildren) == 0 {
+			return head, nil
 		}
 		// Trick: check every depth for a clear 50% winner. This enables us to skip ahead towards the leafs of the tree.
 		// And do so from leaf-level, back towards 0, to get the most out of this trick.
 		// But not the very end, as this will likely not have a majority vote.
 		step := gh.getPowerOf2Below(gh.maxKnownHeight - head.Height) / 2
 		for step > 0 {
-			possibleClearWinner := gh.getClearWinner(latestVotes, head.Height - (head.Height % step) + step)
-			if possibleClearWinner != nil {
+			possibleClearWinner, err := gh.getClearWinner(latestVotes, head, head.Height - (head.Height % step) + step)
+			if err != nil {
+				return nil, err
+			}
+			if possibleClearWinner != nil && gh.dag.IsViable(possibleClearWinner) {
 				head = possibleClearWinner
 				break
 			}
@@ -224,26 +271,32 @@ func (gh *VitaliksOptimizedLMDGhost) HeadFn() *dag.DagNode {
 
 		if step > 0 {
 			// nothing
-		} else if len(head.Children) == 1 {
+		} else if len(viableChildren) == 1 {
 			// Another trick: if there's only 1 child, then you don't have to do any fork-choice at all, just pick it.
 			// Dubbed a "only-child fast-path"
-			head = head.Children[0]
+			head = viableChildren[0]
 		} else {
 			// This process is similar to getVoteCount in the spec implementation,
 			//  but we add up votes for every child with just 1 iteration through all latest-votes.
 			childScores := make(map[*dag.DagNode]int64)
 			for t, w := range latestVotes {
-				if child := gh.getAncestor(t, head.Height + 1); child != nil {
+				child, err := gh.getAncestor(t, head.Height + 1)
+				if err != nil {
+					return nil, err
+				}
+				if child != nil {
 					childScores[child] += w
 				}
 			}
 
 			// Choose the best child
 			// Mod from the original implementation, that did something with the hashes, for binary LMD-GHOST.
-			bestItem := head.Children[0]
+			// Children without votes are considered too, they may still win a tie.
+			var bestItem *dag.DagNode
 			var bestScore int64 = 0
-			for child, childScore := range childScores {
-				if childScore > bestScore {
+			for _, child := range viableChildren {
+				childScore := childScores[child]
+				if bestItem == nil || dag.IsPreferred(child, childScore, bestItem, bestScore) {
 					bestScore = childScore
 					bestItem = child
 				}
@@ -252,17 +305,6 @@ func (gh *VitaliksOptimizedLMDGhost) HeadFn() *dag.DagNode {
 			head = bestItem
 		}
 
-		// No definitive head has been found yet, continue path-finding, after doing some post-processing for this round.
-
-		// Post-process; optimize the graph by removing votes that do not belong to the current head.
-		deletes := make([]*dag.DagNode, 0)
-		for k := range latestVotes {
-			if anc := gh.getAncestor(k, head.Height); anc == nil || anc != head {
-				deletes = append(deletes, k)
-			}
-		}
-		for _, k := range deletes {
-			delete(latestVotes, k)
-		}
+		// No definitive head has been found yet, continue path-finding from the new head.
 	}
 }
@@ -0,0 +1,101 @@
+package vitalik
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"testing"
+)
+
+func (gh *VitaliksOptimizedLMDGhost) ancestorsSize() (count int) {
+	for _, ancMap := range gh.ancestors {
+		count += len(ancMap)
+	}
+	return count
+}
+
+func (gh *VitaliksOptimizedLMDGhost) cacheSize() int {
+	return len(gh.cache) + len(gh.slotCache)
+}
+
+// Three epochs of blocks, with a lighter fork in the third: finalizing the second epoch must not change the head,
+// while the ancestor data and caches of the pruned nodes are dropped.
+func TestPruneKeepsHead(t *testing.T) {
+	d := dag.NewBeaconDag(NewVitaliksOptimizedLMDGhost)
+	gh := d.ForkChoice.(*VitaliksOptimizedLMDGhost)
+
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{2}}
+	cp := genesisCp
+	parent := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	blocks := []*block.BeaconBlock{parent}
+	var forkBase *block.BeaconBlock
+	for i := uint64(1); i < 3 * constants.EPOCH_LENGTH; i++ {
+		b := &block.BeaconBlock{ParentHash: parent.Hash, Hash: common.Hash256{0, uint8(i >> 8), uint8(i)}, Slot: parent.Slot + 1,
+			JustifiedCheckpoint: cp, FinalizedCheckpoint: cp}
+		blocks = append(blocks, b)
+		if i == constants.EPOCH_LENGTH {
+			// blocks after the first epoch agree with it being justified and finalized
+			cp = common.Checkpoint{Epoch: constants.GENESIS_EPOCH + 1, Root: b.Hash}
+		}
+		if i == 2 * constants.EPOCH_LENGTH + 10 {
+			forkBase = b
+		}
+		parent = b
+	}
+	head := parent
+	forkTip := forkBase
+	for i := uint64(1); i < 20; i++ {
+		b := &block.BeaconBlock{ParentHash: forkTip.Hash, Hash: common.Hash256{1, uint8(i >> 8), uint8(i)}, Slot: forkTip.Slot + 1,
+			JustifiedCheckpoint: cp, FinalizedCheckpoint: cp}
+		blocks = append(blocks, b)
+		forkTip = b
+	}
+	for _, b := range blocks {
+		if _, err := d.BlockIn(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := common.ValidatorID(0); id < 10; id++ {
+		target := head
+		if id < 4 {
+			target = forkTip
+		}
+		d.AttestationIn(&attestation.Attestation{BeaconBlockRoot: target.Hash, Attester: id, Slot: target.Slot, Weight: 10})
+	}
+
+	before, err := d.HeadFn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != head.Hash {
+		t.Fatalf("expected head %s before pruning, got %s", head.Hash, before)
+	}
+	ancestorsBefore, cacheBefore := gh.ancestorsSize(), gh.cacheSize()
+	if cacheBefore == 0 {
+		t.Fatal("expected the head lookup to fill the caches")
+	}
+
+	if err := d.Justify(cp); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Finalize(cp); err != nil {
+		t.Fatal(err)
+	}
+	if after := gh.ancestorsSize(); after >= ancestorsBefore {
+		t.Fatalf("expected the ancestor data to shrink after finalization, got %d entries, previously %d", after, ancestorsBefore)
+	}
+	if after := gh.cacheSize(); after >= cacheBefore {
+		t.Fatalf("expected the caches to shrink after finalization, got %d entries, previously %d", after, cacheBefore)
+	}
+
+	after, err := d.HeadFn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after != before {
+		t.Fatalf("expected head %s to stay the head after pruning, got %s", before, after)
+	}
+}
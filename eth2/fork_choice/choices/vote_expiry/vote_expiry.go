@@ -0,0 +1,114 @@
+package vote_expiry
+
+import (
+	"lmd-ghost/eth2/dag"
+)
+
+/// LMD-GHOST where latest messages expire (RLMD-GHOST): only votes of the last expirySlots slots count.
+/// With an expiry of 1 slot, only the votes of the current slot count, like Goldfish.
+/// Expired votes are removed by the DAG (see dag.VoteExpiry), they arrive as negative score changes.
+type VoteExpiryLMDGhost struct {
+
+	dag *dag.BeaconDag
+
+	expirySlots uint64
+
+	latestScores map[*dag.DagNode]int64
+}
+
+/// Creates the fork-choice rule, with votes expiring after the given amount of slots.
+/// Votes are valid for at least one slot: an expiry of 0 is the same as 1.
+func NewVoteExpiryLMDGhost(expirySlots uint64) dag.InitForkChoice {
+	if expirySlots < 1 {
+		expirySlots = 1
+	}
+	return func(d *dag.BeaconDag) dag.ForkChoice {
+		res := &VoteExpiryLMDGhost{
+			dag:          d,
+			expirySlots:  expirySlots,
+			latestScores: make(map[*dag.DagNode]int64),
+		}
+		return res
+	}
+}
+
+func (gh *VoteExpiryLMDGhost) MinVoteSlot(slot uint64) uint64 {
+	if slot + 1 < gh.expirySlots {
+		return 0
+	}
+	return slot + 1 - gh.expirySlots
+}
+
+func (gh *VoteExpiryLMDGhost) ApplyScoreChanges(changes []dag.ScoreChange) error {
+	for _, v := range changes {
+		if v.Target.Slot >= gh.dag.Finalized.Slot {
+			gh.latestScores[v.Target] += v.ScoreDelta
+		}
+	}
+	// delete targets that have a 0 score, expired targets end up here.
+	for k, v := range gh.latestScores {
+		if v == 0 {
+			// deletion during map iteration, safe in Go
+			delete(gh.latestScores, k)
+		}
+	}
+	return nil
+}
+
+func (gh *VoteExpiryLMDGhost) OnNewNode(node *dag.DagNode) error {
+	// free, weights are back-propagated when computing the head
+	return nil
+}
+
+func (gh *VoteExpiryLMDGhost) OnCheckpointsChange() error {
+	// nothing to do, branches are filtered when computing the head
+	return nil
+}
+
+func (gh *VoteExpiryLMDGhost) OnInvalidate(node *dag.DagNode) error {
+	// nothing to do, invalid branches are not viable, and are filtered when computing the head
+	return nil
+}
+
+func (gh *VoteExpiryLMDGhost) OnPrune() error {
+	// prune old latest_scores
+	for k := range gh.latestScores {
+		if k.Slot < gh.dag.Finalized.Slot {
+			delete(gh.latestScores, k)
+		}
+	}
+	return nil
+}
+
+/// Back-propagates the (few) unexpired votes to the justified node, and then descends to the head.
+func (gh *VoteExpiryLMDGhost) HeadFn() (*dag.DagNode, error) {
+	start := gh.dag.Justified
+	weights := make(map[*dag.DagNode]int64)
+	for target, score := range gh.latestScores {
+		// walk up, stop at the justified slot: votes outside of the justified subtree do not count.
+		for n := target; n != nil && n.Slot > start.Slot; n = n.Parent {
+			weights[n] += score
+		}
+	}
+
+	head := start
+	for {
+		var bestItem *dag.DagNode
+		var bestScore int64 = 0
+		for _, child := range head.Children {
+			// only consider viable branches
+			if !gh.dag.IsViable(child) {
+				continue
+			}
+			childVotes := weights[child]
+			if bestItem == nil || dag.IsPreferred(child, childVotes, bestItem, bestScore) {
+				bestScore = childVotes
+				bestItem = child
+			}
+		}
+		if bestItem == nil {
+			return head, nil
+		}
+		head = bestItem
+	}
+}
@@ -0,0 +1,59 @@
+package vote_expiry
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"testing"
+)
+
+func TestZeroExpiryIsOneSlot(t *testing.T) {
+	d := dag.NewBeaconDag(NewVoteExpiryLMDGhost(0))
+	gh := d.ForkChoice.(*VoteExpiryLMDGhost)
+	if slot := constants.GENESIS_SLOT; gh.MinVoteSlot(slot) != slot {
+		t.Fatalf("expected only the votes of the current slot %d to count, got votes from slot %d", slot, gh.MinVoteSlot(slot))
+	}
+}
+
+// Branch a has the most votes, but they are older than the vote for branch b:
+//  the head moves to b once the votes for a expire, after 4 slots.
+func TestVotesExpire(t *testing.T) {
+	const expiry = 4
+	d := dag.NewBeaconDag(NewVoteExpiryLMDGhost(expiry))
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+	g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	a := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{3}, Slot: g.Slot + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	b := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{2}, Slot: g.Slot + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	for _, bl := range []*block.BeaconBlock{g, a, b} {
+		if _, err := d.BlockIn(bl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.OnSlot(a.Slot)
+	for id := common.ValidatorID(0); id < 3; id++ {
+		d.AttestationIn(&attestation.Attestation{BeaconBlockRoot: a.Hash, Attester: id, Slot: a.Slot, Weight: 1})
+	}
+	d.OnSlot(a.Slot + 2)
+	d.AttestationIn(&attestation.Attestation{BeaconBlockRoot: b.Hash, Attester: 3, Slot: a.Slot + 2, Weight: 1})
+
+	for slot := a.Slot + 2; slot < a.Slot + 2 + expiry; slot++ {
+		d.OnSlot(slot)
+		head, err := d.HeadFn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := a.Hash
+		if slot >= a.Slot + expiry {
+			// the votes for a expired, the vote for b did not
+			expected = b.Hash
+		}
+		if head != expected {
+			t.Fatalf("slot %d: expected head %s, got %s", slot, expected, head)
+		}
+	}
+}
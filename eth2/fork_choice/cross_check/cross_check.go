@@ -0,0 +1,260 @@
+package cross_check
+
+import (
+	"fmt"
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/dag"
+	"sort"
+	"strings"
+)
+
+/// A child of the fork-point, competing to be part of the canonical chain.
+type CompetingChild struct {
+
+	Key common.Hash256
+
+	Slot uint64
+
+	// LMD-GHOST weight of the child, computed independently of any fork-choice rule.
+	Weight int64
+
+	// Names of the fork-choice rules that chose this child
+	ChosenBy []string
+}
+
+/// The first point where the fork-choice rules did not agree on the head.
+type Divergence struct {
+
+	// Slot of the latest block that was inserted when the divergence was detected.
+	Slot uint64
+
+	// head per fork-choice rule
+	Heads map[string]common.Hash256
+
+	// The last block all the heads agree on.
+	ForkPoint common.Hash256
+
+	ForkPointSlot uint64
+
+	// All children of the fork-point, with their weights
+	Children []CompetingChild
+}
+
+func (d *Divergence) Error() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("fork-choice rules diverged at slot %d, fork-point %s (slot %d)",
+		d.Slot, d.ForkPoint, d.ForkPointSlot))
+	for _, c := range d.Children {
+		sb.WriteString(fmt.Sprintf("\n  child %s (slot %d) weight %d chosen by %v",
+			c.Key, c.Slot, c.Weight, c.ChosenBy))
+	}
+	names := make([]string, 0, len(d.Heads))
+	for name := range d.Heads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("\n  head %s: %s", name, d.Heads[name]))
+	}
+	return sb.String()
+}
+
+/// Differential checking: runs every fork-choice rule on the same stream of events,
+///  and checks that all of them agree on the head.
+type CrossCheck struct {
+
+	// rule names, sorted, the first one is used as reference
+	Names []string
+
+	// One DAG per fork-choice rule
+	Dags map[string]*dag.BeaconDag
+
+	// The first divergence that was found, nil if the rules agree so far.
+	Divergence *Divergence
+
+	latestSlot uint64
+}
+
+func NewCrossCheck(rules map[string]dag.InitForkChoice) *CrossCheck {
+	res := &CrossCheck{
+		Names: make([]string, 0, len(rules)),
+		Dags: make(map[string]*dag.BeaconDag),
+	}
+	for name, initForkChoice := range rules {
+		res.Names = append(res.Names, name)
+		res.Dags[name] = dag.NewBeaconDag(initForkChoice)
+	}
+	sort.Strings(res.Names)
+	return res
+}
+
+func (cc *CrossCheck) BlockIn(block *block.BeaconBlock) error {
+	if block.Slot > cc.latestSlot {
+		cc.latestSlot = block.Slot
+	}
+	for _, name := range cc.Names {
+		if _, err := cc.Dags[name].BlockIn(block); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (cc *CrossCheck) AttestationIn(atIn *attestation.Attestation) {
+	for _, name := range cc.Names {
+		// every DAG gets its own copy, the aggregator keeps a reference to it.
+		at := *atIn
+		cc.Dags[name].AttestationIn(&at)
+	}
+}
+
+func (cc *CrossCheck) AggregateIn(blockRoot common.Hash256, slot uint64, attesters []common.ValidatorID, weights []uint64) {
+	for _, name := range cc.Names {
+		cc.Dags[name].AggregateIn(blockRoot, slot, attesters, weights)
+	}
+}
+
+func (cc *CrossCheck) UpdateValidatorWeight(id common.ValidatorID, weight uint64) {
+	for _, name := range cc.Names {
+		cc.Dags[name].UpdateValidatorWeight(id, weight)
+	}
+}
+
+func (cc *CrossCheck) RemoveValidatorVote(id common.ValidatorID) {
+	for _, name := range cc.Names {
+		cc.Dags[name].RemoveValidatorVote(id)
+	}
+}
+
+func (cc *CrossCheck) Justify(cp common.Checkpoint) error {
+	for _, name := range cc.Names {
+		if err := cc.Dags[name].Justify(cp); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (cc *CrossCheck) Finalize(cp common.Checkpoint) error {
+	for _, name := range cc.Names {
+		if err := cc.Dags[name].Finalize(cp); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (cc *CrossCheck) InvalidateBlock(blockHash common.Hash256) error {
+	for _, name := range cc.Names {
+		if err := cc.Dags[name].InvalidateBlock(blockHash); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (cc *CrossCheck) ApplyProposerBoost(blockHash common.Hash256, committeeWeight uint64) {
+	for _, name := range cc.Names {
+		cc.Dags[name].ApplyProposerBoost(blockHash, committeeWeight)
+	}
+}
+
+func (cc *CrossCheck) ExpireProposerBoost() {
+	for _, name := range cc.Names {
+		cc.Dags[name].ExpireProposerBoost()
+	}
+}
+
+func (cc *CrossCheck) OnSlot(slot uint64) {
+	for _, name := range cc.Names {
+		cc.Dags[name].OnSlot(slot)
+	}
+}
+
+/// Computes the head with every fork-choice rule.
+/// Returns the head if all rules agree, or the divergence otherwise.
+/// The first divergence is remembered.
+func (cc *CrossCheck) HeadFn() (common.Hash256, error) {
+	heads := make(map[string]common.Hash256, len(cc.Names))
+	for _, name := range cc.Names {
+		head, err := cc.Dags[name].HeadFn()
+		if err != nil {
+			return common.Hash256{}, fmt.Errorf("%s: %v", name, err)
+		}
+		heads[name] = head
+	}
+	ref := heads[cc.Names[0]]
+	for _, name := range cc.Names[1:] {
+		if heads[name] != ref {
+			d := cc.describeDivergence(heads)
+			if cc.Divergence == nil {
+				cc.Divergence = d
+			}
+			return common.Hash256{}, d
+		}
+	}
+	return ref, nil
+}
+
+func (cc *CrossCheck) describeDivergence(heads map[string]common.Hash256) *Divergence {
+	// all DAGs contain the same blocks, the first one is used to look up nodes and weights.
+	refDag := cc.Dags[cc.Names[0]]
+
+	// find the fork-point: the latest common ancestor of all heads.
+	var forkPoint *dag.DagNode
+	for _, h := range heads {
+		n := refDag.Nodes[h]
+		if forkPoint == nil {
+			forkPoint = n
+		} else {
+			forkPoint = commonAncestor(forkPoint, n)
+		}
+		if forkPoint == nil {
+			break
+		}
+	}
+
+	res := &Divergence{
+		Slot: cc.latestSlot,
+		Heads: heads,
+	}
+	if forkPoint == nil {
+		// heads are in disconnected parts of the DAG, nothing more to describe.
+		return res
+	}
+	res.ForkPoint = forkPoint.Key
+	res.ForkPointSlot = forkPoint.Slot
+
+	res.Children = make([]CompetingChild, 0, len(forkPoint.Children))
+	for _, c := range forkPoint.Children {
+		chosenBy := make([]string, 0)
+		for _, name := range cc.Names {
+			if dag.IsAncestor(c, refDag.Nodes[heads[name]]) {
+				chosenBy = append(chosenBy, name)
+			}
+		}
+		res.Children = append(res.Children, CompetingChild{
+			Key: c.Key,
+			Slot: c.Slot,
+			Weight: refDag.GetWeight(c),
+			ChosenBy: chosenBy,
+		})
+	}
+	return res
+}
+
+func commonAncestor(a *dag.DagNode, b *dag.DagNode) *dag.DagNode {
+	for a != nil && b != nil && a != b {
+		if a.Slot > b.Slot {
+			a = a.Parent
+		} else {
+			b = b.Parent
+		}
+	}
+	if a != b {
+		return nil
+	}
+	return a
+}
@@ -0,0 +1,88 @@
+package cross_check
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/dag"
+	"lmd-ghost/eth2/fork_choice/choices/spec"
+	"testing"
+)
+
+// A deliberately wrong rule: the spec rule, but the head follows the lightest child.
+type lightestChild struct {
+	dag.ForkChoice
+	dag *dag.BeaconDag
+}
+
+func newLightestChild(d *dag.BeaconDag) dag.ForkChoice {
+	return &lightestChild{ForkChoice: spec.NewSpecLMDGhost(d), dag: d}
+}
+
+func (lc *lightestChild) HeadFn() (*dag.DagNode, error) {
+	head := lc.dag.Justified
+	for len(head.Children) > 0 {
+		best := head.Children[0]
+		for _, c := range head.Children[1:] {
+			if lc.dag.GetWeight(c) < lc.dag.GetWeight(best) {
+				best = c
+			}
+		}
+		head = best
+	}
+	return head, nil
+}
+
+func TestDivergence(t *testing.T) {
+	cc := NewCrossCheck(map[string]dag.InitForkChoice{
+		"spec": spec.NewSpecLMDGhost,
+		"wrong": newLightestChild,
+	})
+	genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+	g := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	// a is heavier, b is lighter, after a
+	a := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{2}, Slot: g.Slot + 1,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	a2 := &block.BeaconBlock{ParentHash: a.Hash, Hash: common.Hash256{3}, Slot: g.Slot + 2,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	b := &block.BeaconBlock{ParentHash: g.Hash, Hash: common.Hash256{4}, Slot: g.Slot + 3,
+		JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+	for _, bl := range []*block.BeaconBlock{g, a, a2, b} {
+		if err := cc.BlockIn(bl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cc.AttestationIn(&attestation.Attestation{BeaconBlockRoot: a2.Hash, Attester: 1, Slot: a2.Slot, Weight: 2})
+	cc.AttestationIn(&attestation.Attestation{BeaconBlockRoot: b.Hash, Attester: 2, Slot: b.Slot, Weight: 1})
+
+	if _, err := cc.HeadFn(); err == nil {
+		t.Fatal("expected the rules to diverge")
+	} else if err != cc.Divergence {
+		t.Fatalf("expected the divergence to be returned, got %v", err)
+	}
+	d := cc.Divergence
+	if d.Slot != b.Slot {
+		t.Errorf("expected divergence at slot %d, got %d", b.Slot, d.Slot)
+	}
+	if d.ForkPoint != g.Hash || d.ForkPointSlot != g.Slot {
+		t.Errorf("expected fork-point %s at slot %d, got %s at slot %d", g.Hash, g.Slot, d.ForkPoint, d.ForkPointSlot)
+	}
+	if d.Heads["spec"] != a2.Hash || d.Heads["wrong"] != b.Hash {
+		t.Errorf("expected heads %s (spec) and %s (wrong), got %v", a2.Hash, b.Hash, d.Heads)
+	}
+	expected := []CompetingChild{
+		{Key: a.Hash, Slot: a.Slot, Weight: 2, ChosenBy: []string{"spec"}},
+		{Key: b.Hash, Slot: b.Slot, Weight: 1, ChosenBy: []string{"wrong"}},
+	}
+	if len(d.Children) != len(expected) {
+		t.Fatalf("expected %d competing children, got %d", len(expected), len(d.Children))
+	}
+	for i, e := range expected {
+		c := d.Children[i]
+		if c.Key != e.Key || c.Slot != e.Slot || c.Weight != e.Weight || len(c.ChosenBy) != 1 || c.ChosenBy[0] != e.ChosenBy[0] {
+			t.Errorf("child %d: expected %+v, got %+v", i, e, c)
+		}
+	}
+}
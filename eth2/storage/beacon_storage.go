@@ -3,12 +3,16 @@ package storage
 import (
 	"lmd-ghost/eth2/block"
 	"lmd-ghost/eth2/common"
+	"sync"
 )
 
 /// Very simple storage, to abstract away block-storage from the implementation,
 //  making it easier to integrate the advanced parts like fork-choice etc. into a real client.
+// Safe for concurrent use: lookups only wait for other writes to the storage, not for the chain.
 type BeaconStorage struct {
 
+	lock sync.RWMutex
+
 	blocks map[common.Hash256]*block.BeaconBlock
 
 }
@@ -19,11 +23,21 @@ func NewBeaconStorage() *BeaconStorage {
 }
 
 func (st *BeaconStorage) GetBlock(blockHash common.Hash256) (*block.BeaconBlock, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
 	return st.blocks[blockHash], nil
 }
 
 func (st *BeaconStorage) PutBlock(block *block.BeaconBlock) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
 	st.blocks[block.Hash] = block
 	return nil
 }
 
+func (st *BeaconStorage) DeleteBlock(blockHash common.Hash256) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	delete(st.blocks, blockHash)
+	return nil
+}
@@ -12,25 +12,35 @@ func main()  {
 		ValidatorCount: 40000,
 		LatencyFactor: 0.8,
 		SlotSkipChance: 0.3,
-		BaseAttestWeight: 100,
-		MaxExtraAttestWeight: 10,
+		BaseBalance: 30e9,
+		MaxExtraBalance: 4e9,
+		BalanceChangesPerBlock: 10,
 		Blocks: 10000,
 		AttestationsPerBlock: 1000,
+		AggregatesPerBlock: 10,
+		AggregateParticipation: 0.9,
 		JustifyEpochsAgo: 7,
 		FinalizeEpochsAgo: 10,
 		ForkChoiceRule: "proto_array",
 	}
 
-	s := sim.NewSimulation(config)
+	s, err := sim.NewSimulation(config)
+	if err != nil {
+		log.Fatal(err)
+	}
 	name := config.String()
 
 	log.Println("Start:	", name)
 	startTime := time.Now()
-	s.RunSim()
+	if err := s.RunSim(); err != nil {
+		log.Fatal(err)
+	}
 	endTime := time.Now()
 	log.Println("End: ", name, "took", endTime.Sub(startTime))
 
 	// Optional: write the network graph of the chain to a nodes and edges CSV
-	// s.SaveNetworkGraph()
+	// if err := s.SaveNetworkGraph(); err != nil {
+	// 	log.Fatal(err)
+	// }
 
 }
@@ -6,16 +6,22 @@ import (
 )
 
 type SimConfig struct {
-	// Static amount of validators in simulation. Can be very high, since targets are batched.
+	// Amount of validators at genesis. Can be very high, since targets are batched.
 	ValidatorCount uint64
+	// Validator churn: amount of new validators that activate, and of validators that exit, every epoch.
+	// The latest votes of exited validators stop counting.
+	ActivationsPerEpoch uint64
+	ExitsPerEpoch uint64
 	// Latency factor, an idea taken from the simulation by Vitalik. The higher the factor, the closer proposals are to the head.
 	LatencyFactor float64
 	// The chance to skip a slot, repeats max. 10 times.
 	SlotSkipChance float64
-	// Every attestation will have at least this weight
-	BaseAttestWeight uint64
-	// In addition to the base weight, randomly add 0 - max_extra. Uniform distribution.
-	MaxExtraAttestWeight uint64
+	// Every validator starts with at least this balance, in Gwei. Attestations weigh the effective balance of the attester.
+	BaseBalance uint64
+	// In addition to the base balance, randomly add 0 - max_extra. Uniform distribution.
+	MaxExtraBalance uint64
+	// Amount of balance changes (rewards and penalties) to simulate per simulated block, changing the weight of latest votes.
+	BalanceChangesPerBlock uint64
 	// The amount of blocks to simulate. Not consecutive, but total additions to the tree starting from genesis. Genesis excluded.
 	Blocks uint64
 	// Distance in epochs, from head, to finalize up to. Finalization results in pruning of the DAG.
@@ -24,15 +30,26 @@ type SimConfig struct {
 	JustifyEpochsAgo uint64
 	// Amount of individual attestations to simulate and add per simulated block. Attestations are batched. This may include double attestations by the same validator. Batching will reduce it to one.
 	AttestationsPerBlock uint64
+	// Amount of committee aggregates to simulate and add per simulated block: a random committee of the current slot votes for a random block.
+	AggregatesPerBlock uint64
+	// The chance that a member of the committee participates in the aggregate.
+	AggregateParticipation float64
 	// The name of the fork-choice rule. Generally, names are the same as the packages. Mapping is defined in sim/simulation.go.
 	ForkChoiceRule string
+	// The chance that a validator that already attested in the current slot attests again, to a possibly different block.
+	// Validators are discounted when they equivocate.
+	EquivocationChance float64
+	// Boost the first block of every new slot with a fraction of the committee weight, until the next slot.
+	ProposerBoost bool
+	// Run every fork-choice rule in forkRules on the same events, and stop at the first head they disagree on.
+	CrossCheck bool
 }
 
 func (c *SimConfig) String() string {
 	return strings.Replace(
-		fmt.Sprintf("v%d_lf%f_sc%f_bw%d_ew%d_bl%d_atpb%d_fork-%s",
+		fmt.Sprintf("v%d_lf%f_sc%f_act%d_ex%d_bb%d_eb%d_bl%d_atpb%d_agpb%d_fork-%s",
 		c.ValidatorCount, c.LatencyFactor, c.SlotSkipChance,
-		c.BaseAttestWeight, c.MaxExtraAttestWeight, c.Blocks,
-		c.AttestationsPerBlock, c.ForkChoiceRule),
+		c.ActivationsPerEpoch, c.ExitsPerEpoch, c.BaseBalance, c.MaxExtraBalance, c.Blocks,
+		c.AttestationsPerBlock, c.AggregatesPerBlock, c.ForkChoiceRule),
 		".", "_", -1)
 }
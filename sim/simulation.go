@@ -1,18 +1,23 @@
 package sim
 
 import (
+	"errors"
+	"fmt"
 	"lmd-ghost/eth2/attestations/attestation"
 	"lmd-ghost/eth2/block"
 	"lmd-ghost/eth2/chain"
 	"lmd-ghost/eth2/common"
 	"lmd-ghost/eth2/common/constants"
 	"lmd-ghost/eth2/dag"
+	"lmd-ghost/eth2/data/validator"
+	"lmd-ghost/eth2/fork_choice/cross_check"
 	"lmd-ghost/eth2/fork_choice/choices/cached"
 	"lmd-ghost/eth2/fork_choice/choices/proto_array"
 	"lmd-ghost/eth2/fork_choice/choices/simple_back_prop"
 	"lmd-ghost/eth2/fork_choice/choices/spec"
 	"lmd-ghost/eth2/fork_choice/choices/stateful"
 	"lmd-ghost/eth2/fork_choice/choices/vitalik"
+	"lmd-ghost/eth2/fork_choice/choices/vote_expiry"
 	"lmd-ghost/viz"
 	"log"
 	"math/rand"
@@ -26,6 +31,18 @@ var forkRules = map[string]dag.InitForkChoice {
 	"simple_back_prop": simple_back_prop.NewSimpleBackPropLMDGhost,
 	"stateful": stateful.NewStatefulLMDGhost,
 	"proto_array": proto_array.NewProtoArrayLMDGhost,
+	"proto_array_offset": proto_array.NewProtoArrayOffsetLMDGhost,
+	"proto_array_lazy": proto_array.NewProtoArrayLazyLMDGhost,
+	// votes expire after an epoch (RLMD-GHOST)
+	"vote_expiry": vote_expiry.NewVoteExpiryLMDGhost(constants.EPOCH_LENGTH),
+	// only the votes of the current slot count
+	"goldfish": vote_expiry.NewVoteExpiryLMDGhost(1),
+}
+
+// Rules that are not LMD-GHOST, and choose different heads by design: these are not cross-checked.
+var crossCheckExcluded = map[string]bool {
+	"vote_expiry": true,
+	"goldfish": true,
 }
 
 
@@ -35,11 +52,34 @@ type Simulation struct {
 	Chain *chain.BeaconChain
 
 	Config *SimConfig
+
+	// The current slot: the highest slot of all simulated blocks
+	Slot uint64
+
+	// The current epoch, validators churn at the start of every epoch.
+	epoch uint64
+
+	// Validators that are active, or will activate, and are not exiting: candidates to propose and attest.
+	validators []common.ValidatorID
+
+	nextValidator common.ValidatorID
+
+	// exit epoch -> exiting validators, to remove their votes from the cross-check when they exit.
+	exiting map[uint64][]common.ValidatorID
+
+	// validator -> slot of its latest attestation
+	attestedSlot map[common.ValidatorID]uint64
+
+	// Only when cross-checking is enabled: all fork-choice rules, running on the same events.
+	CrossCheck *cross_check.CrossCheck
 }
 
-func NewSimulation(c *SimConfig) *Simulation {
+func NewSimulation(c *SimConfig) (*Simulation, error) {
 
-	initForkChoice := forkRules[c.ForkChoiceRule]
+	initForkChoice, ok := forkRules[c.ForkChoiceRule]
+	if !ok {
+		return nil, fmt.Errorf("unknown fork-choice rule %q", c.ForkChoiceRule)
+	}
 
 	genesisBlock := &block.BeaconBlock{
 		ParentHash: common.Hash256{0},
@@ -47,24 +87,262 @@ func NewSimulation(c *SimConfig) *Simulation {
 		Proposer: 0,
 		Slot: constants.GENESIS_SLOT,
 	}
+	genesisCheckpoint := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: genesisBlock.Hash}
+	genesisBlock.JustifiedCheckpoint = genesisCheckpoint
+	genesisBlock.FinalizedCheckpoint = genesisCheckpoint
 
 	ch, err := chain.NewBeaconChain(genesisBlock, initForkChoice)
 	if err != nil {
-		panic("Failed to initialize chain for simulation.")
+		return nil, fmt.Errorf("failed to initialize chain for simulation: %v", err)
 	}
 
 	s := &Simulation{
 		RNG:        rand.New(rand.NewSource(1234)),
 		Chain: ch,
 		Config: c,
+		Slot: genesisBlock.Slot,
+		epoch: constants.GENESIS_EPOCH,
+		exiting: make(map[uint64][]common.ValidatorID),
+		attestedSlot: make(map[common.ValidatorID]uint64),
+	}
+	for i := uint64(0); i < c.ValidatorCount; i++ {
+		if err := s.addValidator(constants.GENESIS_EPOCH); err != nil {
+			return nil, err
+		}
+	}
+	if c.CrossCheck {
+		rules := make(map[string]dag.InitForkChoice)
+		for name, initForkChoice := range forkRules {
+			if !crossCheckExcluded[name] {
+				rules[name] = initForkChoice
+			}
+		}
+		s.CrossCheck = cross_check.NewCrossCheck(rules)
+		if err := s.CrossCheck.BlockIn(genesisBlock); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Simulation) blockIn(bl *block.BeaconBlock) error {
+	res, err := s.Chain.BlockIn(bl)
+	if err != nil {
+		return fmt.Errorf("could not insert simulated block %s: %v", bl.Hash, err)
+	}
+	if res != dag.BlockImported {
+		return fmt.Errorf("simulated block %s was not imported", bl.Hash)
+	}
+	if s.CrossCheck != nil {
+		return s.CrossCheck.BlockIn(bl)
+	}
+	return nil
+}
+
+func (s *Simulation) attestationIn(at *attestation.Attestation) error {
+	// the chain weighs the attestation by the effective balance of the attester, the cross-check needs it explicitly.
+	at.Weight, _ = s.Chain.Registry.ActiveBalance(at.Attester)
+	if s.CrossCheck != nil {
+		// the chain may hold on to the attestation, give the cross-check a copy before that.
+		s.CrossCheck.AttestationIn(at)
+	}
+	// validators may attest again to the same block, by chance (see mayAttest), that is a no-op.
+	if _, err := s.Chain.AttestationIn(at); err != nil && err != chain.ErrDuplicateAttestation {
+		return fmt.Errorf("could not insert simulated attestation: %v", err)
+	}
+	return nil
+}
+
+func (s *Simulation) randomBalance() uint64 {
+	balance := s.Config.BaseBalance
+	if s.Config.MaxExtraBalance != 0 {
+		balance += uint64(s.RNG.Int63n(int64(s.Config.MaxExtraBalance)))
+	}
+	return balance
+}
+
+func (s *Simulation) addValidator(activationEpoch uint64) error {
+	v := validator.NewValidator(s.nextValidator, s.randomBalance(), activationEpoch)
+	if err := s.Chain.Registry.Add(v); err != nil {
+		return err
+	}
+	s.validators = append(s.validators, v.Id)
+	s.nextValidator++
+	return nil
+}
+
+/// Picks a random active validator. Validators that did not activate yet are skipped.
+func (s *Simulation) randomValidator() (common.ValidatorID, error) {
+	for i := 0; i < 100 && len(s.validators) > 0; i++ {
+		id := s.validators[s.RNG.Intn(len(s.validators))]
+		if s.Chain.Registry.IsActive(id) {
+			return id, nil
+		}
+	}
+	return 0, errors.New("could not find an active validator")
+}
+
+/// Churns the validator set at the start of the epoch: new validators activate, and random validators exit, the next epoch.
+func (s *Simulation) simChurn(epoch uint64) error {
+	for i := uint64(0); i < s.Config.ActivationsPerEpoch; i++ {
+		if err := s.addValidator(epoch + 1); err != nil {
+			return err
+		}
+	}
+	for i := uint64(0); i < s.Config.ExitsPerEpoch && len(s.validators) > 1; i++ {
+		index := s.RNG.Intn(len(s.validators))
+		id := s.validators[index]
+		if !s.Chain.Registry.IsActive(id) {
+			continue
+		}
+		if err := s.Chain.Registry.Exit(id, epoch + 1); err != nil {
+			return err
+		}
+		s.exiting[epoch + 1] = append(s.exiting[epoch + 1], id)
+		// swap-remove: exiting validators do not propose or attest anymore
+		last := len(s.validators) - 1
+		s.validators[index] = s.validators[last]
+		s.validators = s.validators[:last]
+	}
+	return nil
+}
+
+/// Changes the balance of a random validator, like a reward or penalty would.
+/// Most changes do not change the effective balance, those that do change the weight of the latest vote of the validator.
+func (s *Simulation) SimBalanceChange() error {
+	id, err := s.randomValidator()
+	if err != nil {
+		return err
+	}
+	if err := s.Chain.SetBalance(id, s.randomBalance()); err != nil {
+		return err
+	}
+	if s.CrossCheck != nil {
+		weight, _ := s.Chain.Registry.ActiveBalance(id)
+		s.CrossCheck.UpdateValidatorWeight(id, weight)
 	}
-	return s
+	return nil
+}
+
+/// Gets the checkpoint for the epoch that is the given amount of epochs ago, on the branch of n.
+/// Returns false if there is no such epoch, or if the checkpoint root was pruned.
+func checkpointAgo(n *dag.DagNode, epoch uint64, epochsAgo uint64) (common.Checkpoint, bool) {
+	if epoch < constants.GENESIS_EPOCH + epochsAgo {
+		return common.Checkpoint{}, false
+	}
+	cpEpoch := epoch - epochsAgo
+	// the root is the block at the start of the epoch, or the latest block before it, if the slot is empty.
+	root := n
+	for root != nil && root.Slot > cpEpoch * constants.EPOCH_LENGTH {
+		root = root.Parent
+	}
+	if root == nil {
+		return common.Checkpoint{}, false
+	}
+	return common.Checkpoint{Epoch: cpEpoch, Root: root.Key}, true
+}
+
+/// Like the store in the spec, the justified and finalized checkpoints are updated with newer ones from blocks.
+func (s *Simulation) updateCheckpoints(bl *block.BeaconBlock) error {
+	d := s.Chain.Dag
+	if bl.FinalizedCheckpoint.Epoch > d.FinalizedCheckpoint.Epoch {
+		// the justified checkpoint of the block comes with the new finalized checkpoint
+		if err := s.justify(bl.JustifiedCheckpoint); err != nil {
+			return err
+		}
+		return s.finalize(bl.FinalizedCheckpoint)
+	} else if bl.JustifiedCheckpoint.Epoch > d.JustifiedCheckpoint.Epoch {
+		return s.justify(bl.JustifiedCheckpoint)
+	}
+	return nil
+}
+
+func (s *Simulation) justify(cp common.Checkpoint) error {
+	if err := s.Chain.Justify(cp); err != nil {
+		return err
+	}
+	if s.CrossCheck != nil {
+		return s.CrossCheck.Justify(cp)
+	}
+	return nil
+}
+
+func (s *Simulation) finalize(cp common.Checkpoint) error {
+	if err := s.Chain.Finalize(cp); err != nil {
+		return err
+	}
+	if s.CrossCheck != nil {
+		return s.CrossCheck.Finalize(cp)
+	}
+	return nil
+}
+
+/// Starts a new slot, votes may expire. A new epoch churns the validator set.
+func (s *Simulation) onSlot(slot uint64) error {
+	if err := s.Chain.OnSlot(slot); err != nil {
+		return err
+	}
+	epoch := slot / constants.EPOCH_LENGTH
+	if s.CrossCheck != nil {
+		// the chain removes the votes of exited validators itself, the cross-check needs to be told.
+		for e, ids := range s.exiting {
+			if e > epoch {
+				continue
+			}
+			for _, id := range ids {
+				s.CrossCheck.RemoveValidatorVote(id)
+			}
+		}
+		s.CrossCheck.OnSlot(slot)
+	}
+	for e := range s.exiting {
+		if e <= epoch {
+			delete(s.exiting, e)
+		}
+	}
+	if epoch > s.epoch {
+		s.epoch = epoch
+		return s.simChurn(epoch)
+	}
+	return nil
+}
+
+func (s *Simulation) applyProposerBoost(blockHash common.Hash256) error {
+	// committee weight: all validators attest once per epoch, a committee is a slot worth of them
+	committeeWeight := s.Chain.Registry.TotalActiveBalance() / constants.EPOCH_LENGTH
+	if err := s.Chain.ApplyProposerBoost(blockHash, committeeWeight); err != nil {
+		return err
+	}
+	if s.CrossCheck != nil {
+		s.CrossCheck.ApplyProposerBoost(blockHash, committeeWeight)
+	}
+	return nil
+}
+
+func (s *Simulation) expireProposerBoost() error {
+	if err := s.Chain.ExpireProposerBoost(); err != nil {
+		return err
+	}
+	if s.CrossCheck != nil {
+		s.CrossCheck.ExpireProposerBoost()
+	}
+	return nil
+}
+
+/// Checks if all fork-choice rules agree on the head, if cross-checking is enabled.
+/// Returns the divergence (see cross_check.Divergence) when they do not.
+func (s *Simulation) crossCheckHeads() error {
+	if s.CrossCheck == nil {
+		return nil
+	}
+	_, err := s.CrossCheck.HeadFn()
+	return err
 }
 
 /// Goes up (towards slot 0) the tree by a few steps (upCount, more with more latency) and then back down a random path.
 func (s *Simulation) getRandomTarget() *dag.DagNode {
 	upCount := 0
-	target := s.Chain.Dag.Nodes[s.Chain.Head]
+	target := s.Chain.Dag.Nodes[s.Chain.Head()]
 	for {
 		if target.Parent != nil && s.RNG.Float64() < s.Config.LatencyFactor {
 			target = target.Parent
@@ -84,7 +362,7 @@ func (s *Simulation) getRandomTarget() *dag.DagNode {
 	return target
 }
 
-func (s *Simulation) SimNewBlock() {
+func (s *Simulation) SimNewBlock() error {
 	// random parent block, derived from the current head, but perturbed; latency may introduce a fork in the chain
 	parentBlock := s.getRandomTarget()
 
@@ -98,114 +376,213 @@ func (s *Simulation) SimNewBlock() {
 
 	// get a random proposer
 	// [divergence from spec: there's a slight chance that a proposer proposes twice in the same epoch]
-	proposer := common.ValidatorID(s.RNG.Intn(int(s.Config.ValidatorCount)))
+	proposer, err := s.randomValidator()
+	if err != nil {
+		return err
+	}
 
 	// random block-hash
 	blockHash := common.Hash256{}
 	s.RNG.Read(blockHash[:])
 
+	// checkpoints of the block: justification and finalization follow the branch of the block, some epochs behind.
+	justified, finalized := parentBlock.JustifiedCheckpoint, parentBlock.FinalizedCheckpoint
+	blockEpoch := blockSlot / constants.EPOCH_LENGTH
+	if j, ok := checkpointAgo(parentBlock, blockEpoch, s.Config.JustifyEpochsAgo); ok && j.Epoch > justified.Epoch {
+		justified = j
+	}
+	if f, ok := checkpointAgo(parentBlock, blockEpoch, s.Config.FinalizeEpochsAgo); ok && f.Epoch > finalized.Epoch {
+		finalized = f
+	}
+
 	// create the block
-	bl := &block.BeaconBlock{ParentHash: parentBlock.Key, Hash: blockHash, Proposer: proposer, Slot: blockSlot}
+	bl := &block.BeaconBlock{ParentHash: parentBlock.Key, Hash: blockHash, Proposer: proposer, Slot: blockSlot,
+		JustifiedCheckpoint: justified, FinalizedCheckpoint: finalized}
+
+	// a block for a new slot starts that slot, the boost of the previous slot expires.
+	timely := blockSlot > s.Slot
+	if timely {
+		s.Slot = blockSlot
+		if err := s.onSlot(blockSlot); err != nil {
+			return err
+		}
+		if s.Config.ProposerBoost {
+			if err := s.expireProposerBoost(); err != nil {
+				return err
+			}
+		}
+	}
 
 	// add it to the chain
-	if err := s.Chain.BlockIn(bl); err != nil {
-		panic("Could not insert simulated new block")
+	if err := s.blockIn(bl); err != nil {
+		return err
+	}
+	if err := s.updateCheckpoints(bl); err != nil {
+		return err
 	}
 
-	weight := s.Config.BaseAttestWeight
-	if s.Config.MaxExtraAttestWeight != 0 {
-		weight += uint64(s.RNG.Intn(int(s.Config.MaxExtraAttestWeight)))
+	// the first block of a slot is timely, and boosted
+	if timely && s.Config.ProposerBoost {
+		if err := s.applyProposerBoost(bl.Hash); err != nil {
+			return err
+		}
 	}
 
 	// make the proposer attest its own block
-	at := &attestation.Attestation{BeaconBlockRoot: bl.Hash, Attester: bl.Proposer, Weight: uint64(weight)}
-	if err := s.Chain.AttestationIn(at); err != nil {
-		panic("Could not insert simulated attestation")
+	if !s.mayAttest(bl.Proposer) {
+		return nil
 	}
+	at := &attestation.Attestation{BeaconBlockRoot: bl.Hash, Attester: bl.Proposer, Slot: s.Slot}
+	return s.attestationIn(at)
 }
 
-func (s *Simulation) SimNewAttestation() {
+func (s *Simulation) SimNewAttestation() error {
 	// get random block
 	target := s.getRandomTarget()
 
 	// select a random validator (every validator is allowed to attest here)
-	attester := common.ValidatorID(s.RNG.Intn(int(s.Config.ValidatorCount)))
+	attester, err := s.randomValidator()
+	if err != nil {
+		return err
+	}
 
-	weight := s.Config.BaseAttestWeight
-	if s.Config.MaxExtraAttestWeight != 0 {
-		weight += uint64(s.RNG.Intn(int(s.Config.MaxExtraAttestWeight)))
+	if !s.mayAttest(attester) {
+		return nil
 	}
 
-	// make the attestation happen
-	at := &attestation.Attestation{BeaconBlockRoot: target.Key, Attester: attester, Weight: uint64(weight)}
-	if err := s.Chain.AttestationIn(at); err != nil {
-		panic("Could not insert simulated attestation")
+	// make the attestation happen, the chain weighs it by the effective balance of the attester
+	at := &attestation.Attestation{BeaconBlockRoot: target.Key, Attester: attester, Slot: s.Slot}
+	return s.attestationIn(at)
+}
+
+func (s *Simulation) SimNewAggregate() error {
+	count, err := s.Chain.Registry.CommitteeCount(s.Slot)
+	if err != nil {
+		return err
+	}
+	index := uint64(s.RNG.Intn(int(count)))
+	committee, err := s.Chain.Registry.Committee(s.Slot, index)
+	if err != nil {
+		return err
 	}
+	// get random block
+	target := s.getRandomTarget()
+
+	agg := attestation.NewAggregateAttestation(target.Key, s.Slot, index, len(committee))
+	participants := 0
+	for i, v := range committee {
+		if s.RNG.Float64() < s.Config.AggregateParticipation && s.mayAttest(v.Id) {
+			agg.SetParticipant(i)
+			participants++
+		}
+	}
+	if participants == 0 {
+		return nil
+	}
+	if s.CrossCheck != nil {
+		attesters, weights, err := s.Chain.ExpandAggregate(agg)
+		if err != nil {
+			return err
+		}
+		s.CrossCheck.AggregateIn(agg.BeaconBlockRoot, agg.Slot, attesters, weights)
+	}
+	_, err = s.Chain.AggregateAttestationIn(agg)
+	return err
+}
+
+/// Validators attest at most once per slot, unless they equivocate (by chance, see config).
+func (s *Simulation) mayAttest(attester common.ValidatorID) bool {
+	if slot, ok := s.attestedSlot[attester]; ok && slot == s.Slot {
+		if s.RNG.Float64() >= s.Config.EquivocationChance {
+			return false
+		}
+	}
+	s.attestedSlot[attester] = s.Slot
+	return true
 }
 
 // TODO parametrize latency, simulated attestations per block, and slot-skip
-func (s *Simulation) RunSim() {
-	// log every 5% of the simulated amount of blocks
-	logInterval := s.Config.Blocks / 20
-	// update the head 10 times during attestation processing.
-	headUpdateInterval := s.Config.AttestationsPerBlock / 10
-	attestationCounter := uint64(0)
+func (s *Simulation) RunSim() error {
 	if s.Config.FinalizeEpochsAgo < s.Config.JustifyEpochsAgo {
-		panic("invalid config: finalization happens quicker than justification in config")
+		return errors.New("invalid config: finalization happens quicker than justification in config")
 	}
 	if s.Config.FinalizeEpochsAgo < 1 {
-		panic("finalization is too quick")
+		return errors.New("invalid config: finalization is too quick")
 	}
 	if s.Config.JustifyEpochsAgo < 1 {
-		panic("justification is too quick")
+		return errors.New("invalid config: justification is too quick")
 	}
+	// log every 5% of the simulated amount of blocks
+	logInterval := s.Config.Blocks / 20
+	// update the head 10 times during attestation processing.
+	headUpdateInterval := s.Config.AttestationsPerBlock / 10
+	// small simulations log every block, and update the head after every attestation.
+	if logInterval == 0 {
+		logInterval = 1
+	}
+	if headUpdateInterval == 0 {
+		headUpdateInterval = 1
+	}
+	attestationCounter := uint64(0)
 	for n := uint64(0); n < s.Config.Blocks; n++ {
-		head := s.Chain.Dag.Nodes[s.Chain.Head]
-		epoch := head.Slot / constants.EPOCH_LENGTH
-		if epoch > s.Config.FinalizeEpochsAgo {
-			finalizedEpoch := epoch - s.Config.FinalizeEpochsAgo
-			if finalizedEpoch > s.Chain.Dag.Finalized.Slot/constants.EPOCH_LENGTH {
-				f := s.Chain.Dag.Justified
-				for f != nil && f.Slot/constants.EPOCH_LENGTH > finalizedEpoch {
-					f = f.Parent
-				}
-				if f != nil && f != s.Chain.Dag.Finalized {
-					s.Chain.Dag.Finalize(f.Key)
-				}
-			}
-		}
-		if epoch > s.Config.JustifyEpochsAgo {
-			justifiedEpoch := epoch - s.Config.JustifyEpochsAgo
-			if justifiedEpoch > s.Chain.Dag.Justified.Slot/constants.EPOCH_LENGTH {
-				j := head
-				for j != nil && j.Slot/constants.EPOCH_LENGTH > justifiedEpoch {
-					j = j.Parent
-				}
-				if j != nil && j != s.Chain.Dag.Justified {
-					s.Chain.Dag.Justify(j.Key)
-				}
-			}
-		}
-
 		if n % logInterval == 0 {
 			log.Printf("total %d blocks added, %d blocks in dag, head at slot: %d, processed %d attestations.\n",
-				n, len(s.Chain.Dag.Nodes), s.Chain.Dag.Nodes[s.Chain.Head].Slot - constants.GENESIS_SLOT, attestationCounter)
+				n, len(s.Chain.Dag.Nodes), s.Chain.Dag.Nodes[s.Chain.Head()].Slot - constants.GENESIS_SLOT, attestationCounter)
 		}
 		for a := uint64(0); a < s.Config.AttestationsPerBlock; a++ {
-			s.SimNewAttestation()
+			if err := s.SimNewAttestation(); err != nil {
+				return err
+			}
 			if a % headUpdateInterval == headUpdateInterval - 1 {
-				s.Chain.UpdateHead()
+				if err := s.updateHead(); err != nil {
+					return err
+				}
 			}
 		}
 		attestationCounter += s.Config.AttestationsPerBlock
+		for a := uint64(0); a < s.Config.AggregatesPerBlock; a++ {
+			if err := s.SimNewAggregate(); err != nil {
+				return err
+			}
+		}
+		if s.Config.AggregatesPerBlock > 0 {
+			if err := s.updateHead(); err != nil {
+				return err
+			}
+		}
+		// the head updates with every balance change that changes the weight of a vote
+		for b := uint64(0); b < s.Config.BalanceChangesPerBlock; b++ {
+			if err := s.SimBalanceChange(); err != nil {
+				return err
+			}
+		}
+		if err := s.crossCheckHeads(); err != nil {
+			return err
+		}
 		// head will update after adding a block
-		s.SimNewBlock()
+		if err := s.SimNewBlock(); err != nil {
+			return err
+		}
+		if err := s.crossCheckHeads(); err != nil {
+			return err
+		}
 	}
 	log.Printf("total %d blocks added, %d blocks in dag, head at slot: %d, processed %d attestations.\n",
-		s.Config.Blocks, len(s.Chain.Dag.Nodes), s.Chain.Dag.Nodes[s.Chain.Head].Slot - constants.GENESIS_SLOT, attestationCounter)
+		s.Config.Blocks, len(s.Chain.Dag.Nodes), s.Chain.Dag.Nodes[s.Chain.Head()].Slot - constants.GENESIS_SLOT, attestationCounter)
+	if equivocators := s.Chain.EquivocatingValidators(); len(equivocators) > 0 {
+		log.Printf("found %d equivocating validators.\n", len(equivocators))
+	}
+	return nil
 }
 
-func (s *Simulation) SaveNetworkGraph() {
+func (s *Simulation) updateHead() error {
+	if err := s.Chain.UpdateHead(); err != nil {
+		return err
+	}
+	return s.crossCheckHeads()
+}
+
+func (s *Simulation) SaveNetworkGraph() error {
 	simName := s.Config.String()
-	viz.CreateVizGraph("out/" + simName, s.Chain)
-}
\ No newline at end of file
+	return viz.CreateVizGraph("out/" + simName, s.Chain)
+}
@@ -0,0 +1,181 @@
+package sim
+
+import (
+	"lmd-ghost/eth2/attestations/attestation"
+	"lmd-ghost/eth2/block"
+	"lmd-ghost/eth2/chain"
+	"lmd-ghost/eth2/common"
+	"lmd-ghost/eth2/common/constants"
+	"lmd-ghost/eth2/data/validator"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// Blocks, attestations and head updates from several goroutines, while the head and its block are read.
+// Run with -race: the chain must serialize all access to the dag and the fork-choice rule.
+func TestConcurrentChainAccess(t *testing.T) {
+	for name, initForkChoice := range forkRules {
+		initForkChoice := initForkChoice
+		t.Run(name, func(t *testing.T) {
+			genesisCp := common.Checkpoint{Epoch: constants.GENESIS_EPOCH, Root: common.Hash256{1}}
+			genesis := &block.BeaconBlock{Hash: genesisCp.Root, Slot: constants.GENESIS_SLOT,
+				JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+			ch, err := chain.NewBeaconChain(genesis, initForkChoice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			const validators = 100
+			for i := 0; i < validators; i++ {
+				if err := ch.Registry.Add(validator.NewValidator(common.ValidatorID(i), constants.MAX_EFFECTIVE_BALANCE, constants.GENESIS_EPOCH)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the imported blocks, to build on and to vote for
+			var knownLock sync.Mutex
+			known := []*block.BeaconBlock{genesis}
+			pick := func(rng *rand.Rand) *block.BeaconBlock {
+				knownLock.Lock()
+				defer knownLock.Unlock()
+				return known[rng.Intn(len(known))]
+			}
+
+			var writers sync.WaitGroup
+			for w := 0; w < 2; w++ {
+				writers.Add(1)
+				go func(seed int64) {
+					defer writers.Done()
+					rng := rand.New(rand.NewSource(seed))
+					for i := 0; i < 50; i++ {
+						parent := pick(rng)
+						b := &block.BeaconBlock{ParentHash: parent.Hash, Slot: parent.Slot + 1 + uint64(rng.Intn(2)),
+							Proposer: common.ValidatorID(rng.Intn(validators)), JustifiedCheckpoint: genesisCp, FinalizedCheckpoint: genesisCp}
+						rng.Read(b.Hash[:])
+						if err := ch.OnSlot(b.Slot); err != nil {
+							t.Error(err)
+							return
+						}
+						if _, err := ch.BlockIn(b); err != nil {
+							t.Error(err)
+							return
+						}
+						knownLock.Lock()
+						known = append(known, b)
+						knownLock.Unlock()
+						runtime.Gosched()
+					}
+				}(int64(w))
+			}
+			for w := 0; w < 3; w++ {
+				writers.Add(1)
+				go func(seed int64) {
+					defer writers.Done()
+					rng := rand.New(rand.NewSource(seed))
+					for i := 0; i < 300; i++ {
+						b := pick(rng)
+						at := &attestation.Attestation{BeaconBlockRoot: b.Hash, Attester: common.ValidatorID(rng.Intn(validators)), Slot: b.Slot}
+						if _, err := ch.AttestationIn(at); err != nil && err != chain.ErrDuplicateAttestation {
+							t.Error(err)
+							return
+						}
+						runtime.Gosched()
+						if i % 20 == 0 {
+							if err := ch.UpdateHead(); err != nil {
+								t.Error(err)
+								return
+							}
+						}
+					}
+				}(int64(100 + w))
+			}
+
+			done := make(chan struct{})
+			var readers sync.WaitGroup
+			for r := 0; r < 2; r++ {
+				readers.Add(1)
+				go func() {
+					defer readers.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						head := ch.Head()
+						if b, _ := ch.GetBlock(head); b == nil {
+							t.Errorf("head %s is not in storage", head)
+							return
+						}
+						// interleave with the writers, also on a single core
+						runtime.Gosched()
+					}
+				}()
+			}
+			writers.Wait()
+			close(done)
+			readers.Wait()
+		})
+	}
+}
+
+// A short simulation with every feature enabled: all LMD-GHOST rules must agree on every head.
+func TestCrossCheckSim(t *testing.T) {
+	config := &SimConfig{
+		ValidatorCount: 1000,
+		ActivationsPerEpoch: 4,
+		ExitsPerEpoch: 4,
+		LatencyFactor: 0.8,
+		SlotSkipChance: 0.3,
+		BaseBalance: 30e9,
+		MaxExtraBalance: 4e9,
+		BalanceChangesPerBlock: 5,
+		Blocks: 120,
+		AttestationsPerBlock: 50,
+		AggregatesPerBlock: 2,
+		AggregateParticipation: 0.9,
+		JustifyEpochsAgo: 1,
+		FinalizeEpochsAgo: 2,
+		ForkChoiceRule: "spec",
+		EquivocationChance: 0.05,
+		ProposerBoost: true,
+		CrossCheck: true,
+	}
+	s, err := NewSimulation(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RunSim(); err != nil {
+		t.Fatal(err)
+	}
+	if s.CrossCheck.Divergence != nil {
+		t.Fatal(s.CrossCheck.Divergence)
+	}
+}
+
+// Fewer blocks and attestations per block than there are log and head-update intervals.
+func TestSmallSim(t *testing.T) {
+	config := &SimConfig{
+		ValidatorCount: 100,
+		LatencyFactor: 0.8,
+		SlotSkipChance: 0.3,
+		BaseBalance: 32e9,
+		Blocks: 10,
+		AttestationsPerBlock: 5,
+		JustifyEpochsAgo: 1,
+		FinalizeEpochsAgo: 2,
+		ForkChoiceRule: "proto_array",
+		CrossCheck: true,
+	}
+	s, err := NewSimulation(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RunSim(); err != nil {
+		t.Fatal(err)
+	}
+	if s.CrossCheck.Divergence != nil {
+		t.Fatal(s.CrossCheck.Divergence)
+	}
+}
@@ -4,35 +4,44 @@ import (
 	"encoding/csv"
 	"fmt"
 	"lmd-ghost/eth2/chain"
-	"log"
 	"os"
 )
 
-func CreateVizGraph(path string, ch *chain.BeaconChain) {
-	writeNodesCSV(path + ".nodes.csv", ch)
-	writeEdgesCSV(path + ".edges.csv", ch)
+/// Writes the nodes and edges of the dag to CSV files, for graphing software.
+/// Reads the dag directly: do not call while other goroutines change the chain.
+func CreateVizGraph(path string, ch *chain.BeaconChain) error {
+	if err := writeNodesCSV(path + ".nodes.csv", ch); err != nil {
+		return err
+	}
+	return writeEdgesCSV(path + ".edges.csv", ch)
 }
 
-func check(err error, msg string) {
+// Adds context to the error, if any.
+func wrap(err error, msg string) error {
 	if err != nil {
-		// TODO combine error + extra msg in a nice way
-		log.Println(msg)
-		panic(err)
+		return fmt.Errorf("%s: %v", msg, err)
 	}
+	return nil
 }
 
-func writeNodesCSV(path string, ch *chain.BeaconChain) {
+func writeNodesCSV(path string, ch *chain.BeaconChain) error {
 	file, err := os.Create(path)
-	check(err, "Could not create nodes-CSV file")
+	if err != nil {
+		return wrap(err, "could not create nodes-CSV file")
+	}
+	defer file.Close()
 
 	writer := csv.NewWriter(file)
 
-	check(writer.Write([]string{"ID","Label","Slot","x","Proposer","BlockType"}), "failed to write nodes-CSV header")
+	if err := writer.Write([]string{"ID","Label","Slot","x","Proposer","BlockType"}); err != nil {
+		return wrap(err, "failed to write nodes-CSV header")
+	}
 
+	head := ch.Head()
 	for hash := range ch.Dag.Nodes {
 		id := hash.String()
 		blockType := "normal"
-		if hash == ch.Head {
+		if hash == head {
 			blockType = "head"
 		} else if hash == ch.Dag.Justified.Key {
 			blockType = "justified"
@@ -41,9 +50,12 @@ func writeNodesCSV(path string, ch *chain.BeaconChain) {
 		}
 		block, err := ch.Storage.GetBlock(hash)
 		if err != nil {
-			panic("Could not find block from DAG in storage")
+			return wrap(err, "could not get block " + id + " from storage")
+		}
+		if block == nil {
+			return fmt.Errorf("could not find block %s from DAG in storage", id)
 		}
-		check(writer.Write([]string{
+		if err := writer.Write([]string{
 			id, id, // id and label
 			fmt.Sprintf("%d", block.Slot),
 			fmt.Sprintf("%d", block.Slot + 1),// x: slot + 1, graphing software want coordinates 1 - N ...
@@ -51,19 +63,29 @@ func writeNodesCSV(path string, ch *chain.BeaconChain) {
 			blockType,
 			// TODO maybe also add votes to graph?
 			//  (Problem: would require stateful LMD-GHOST version, doesn't work for others)
-		}), "failed to write CSV node for block " + id)
+		}); err != nil {
+			return wrap(err, "failed to write CSV node for block " + id)
+		}
 	}
 	writer.Flush()
-	check(file.Close(), "could not close nodes-CSV file")
+	if err := writer.Error(); err != nil {
+		return wrap(err, "failed to write nodes-CSV file")
+	}
+	return wrap(file.Close(), "could not close nodes-CSV file")
 }
 
-func writeEdgesCSV(path string, ch *chain.BeaconChain) {
+func writeEdgesCSV(path string, ch *chain.BeaconChain) error {
 	file, err := os.Create(path)
-	check(err, "Could not create edges-CSV file")
+	if err != nil {
+		return wrap(err, "could not create edges-CSV file")
+	}
+	defer file.Close()
 
 	writer := csv.NewWriter(file)
 
-	check(writer.Write([]string{"Source","Target"}), "failed to write edges-CSV header")
+	if err := writer.Write([]string{"Source","Target"}); err != nil {
+		return wrap(err, "failed to write edges-CSV header")
+	}
 
 	for hash, block := range ch.Dag.Nodes {
 		if block.Parent == nil {
@@ -73,9 +95,14 @@ func writeEdgesCSV(path string, ch *chain.BeaconChain) {
 		//  if we we're using the stateful LMD-GHOST version
 		id := hash.String()
 		parentId := block.Parent.Key.String()
-		check(writer.Write([]string{parentId, id}), "failed to write CSV edge for block " + id)
+		if err := writer.Write([]string{parentId, id}); err != nil {
+			return wrap(err, "failed to write CSV edge for block " + id)
+		}
 	}
 
 	writer.Flush()
-	check(file.Close(), "could not close edges-CSV file")
+	if err := writer.Error(); err != nil {
+		return wrap(err, "failed to write edges-CSV file")
+	}
+	return wrap(file.Close(), "could not close edges-CSV file")
 }